@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/zjx20/protodump/pkg/protodump"
@@ -68,8 +70,13 @@ func main() {
 		log.Fatalf("Couldn't determine current working directory: %v\n", err)
 	}
 
-	var file = flag.String("file", "", "The file to extract definitions from")
+	var file = flag.String("file", "", "The file to extract definitions from. Standalone descriptor sets (.pb, .desc, .protoset) are read directly.")
 	var output = flag.String("output", cwd, "The output directory to save definitions in (will be created if it doesn't exist). Defaults to current directory.")
+	var goPackage = flag.Bool("go-package", false, "Reconstruct missing go_package options from the Go package that registered each descriptor")
+	var stubs = flag.Bool("stubs", false, "Write stub files for imports that weren't found, declaring the types the dump uses from them")
+	var skipWKT = flag.Bool("skip-wkt", false, "Don't write well-known types files (google/protobuf/*.proto), which protoc already ships")
+	var provenance = flag.Bool("provenance", false, "Start every definition with where its descriptor was found: input, location, offset, SHA-256, extraction method and protodump version")
+	var warnings = flag.Bool("warnings", false, "Write what couldn't be represented faithfully as // protodump: warning: comments in the definitions")
 	flag.BoolVar(&debug, "v", false, "Verbose output")
 	flag.Parse()
 
@@ -84,33 +91,126 @@ func main() {
 		return
 	}
 
-	results, err := protodump.ScanFile(*file)
+	results, image, err := protodump.ScanFileImage(*file)
 	if err != nil {
 		log.Fatalf("Got error scanning: %v\n", err)
 	}
 
+	runtimeInfo := protodump.ReadRuntimeInfo(image)
+	header := append([]string{"Extracted by protodump from " + filepath.Base(*file)}, runtimeInfo.Summary()...)
+
 	err = os.MkdirAll(*output, 0700)
 	if err != nil {
 		log.Fatalf("Failed to create output folder %s: %v\n", *output, err)
 	}
 
-	for _, result := range results {
-		definition, err := protodump.NewFromBytes(result)
-		if err != nil {
-			Debug("Got error parsing definition: %v\n", err)
+	// All descriptors are parsed together, so that types and custom options
+	// resolve across the files of the binary
+	payloads := make([][]byte, len(results))
+	for i, result := range results {
+		payloads[i] = result.Data
+	}
+	batch := protodump.NewBatchFromBytes(payloads)
+
+	var lastSet *protodump.DescriptorSet
+	for i, result := range results {
+		if result.Set != nil && result.Set != lastSet {
+			Debug("Found FileDescriptorSet at offset %d with %d files (%d bytes)\n",
+				result.Set.Offset, result.Set.Files, result.Set.Length)
+			lastSet = result.Set
+		}
+		Debug("Found %s descriptor at offset %d (%d bytes)\n", result.Method, result.Offset, result.Length)
+		if result.Location != "" {
+			Debug("Located in %s\n", result.Location)
+		}
+		if result.GoPackage != "" {
+			Debug("Registered by Go package %s\n", result.GoPackage)
+		}
+
+		definition := batch.Definitions[i]
+		if definition == nil {
+			Debug("Got error parsing definition: %v\n", batch.Errors[i])
+			continue
+		}
+		if definition.IsWellKnown() {
+			Debug("%s is a well-known types file\n", definition.FileDescriptorProto().GetName())
+			if *skipWKT {
+				continue
+			}
+		}
+
+		fileHeader := header
+		if result.GoPackage != "" {
+			fileHeader = append(append([]string{}, header...), "Go package: "+result.GoPackage)
+		}
+		if *provenance {
+			fileHeader = append(append([]string{}, fileHeader...), result.Provenance(*file)...)
+		}
+		if *goPackage {
+			definition.RestoreGoPackage(result.GoPackage)
+		}
+		definition.SetHeader(fileHeader)
+		var content bytes.Buffer
+		definition.Render(&content, protodump.RenderOptions{InlineWarnings: *warnings})
+		// Fields of a newer descriptor.proto are only kept as comments
+		for _, unknown := range definition.UnknownFields() {
+			fmt.Printf("Warning: unknown field in %s at %s\n", definition.FileDescriptorProto().GetName(), unknown)
+		}
+		for _, diagnostic := range definition.Diagnostics() {
+			Debug("Diagnostic in %s: %s\n", definition.FileDescriptorProto().GetName(), diagnostic)
+		}
+		filename := definition.Filename()
+		if strings.HasSuffix(filename, ".proto") {
+			final, err := writeFile(*output, filename, content.Bytes())
+			if err != nil {
+				fmt.Printf("Failed to write %s: %v\n", final, err)
+			} else {
+				fmt.Printf("Wrote %s\n", final)
+			}
 		} else {
+			// Need to investigate further
+		}
+	}
 
-			filename := definition.Filename()
-			if strings.HasSuffix(filename, ".proto") {
-				final, err := writeFile(*output, filename, []byte(definition.String()))
-				if err != nil {
-					fmt.Printf("Failed to write %s: %v\n", final, err)
-				} else {
-					fmt.Printf("Wrote %s\n", final)
-				}
+	// Imported well-known types that the binary doesn't contain are written
+	// as they ship with protoc
+	if !*skipWKT {
+		for _, canonical := range batch.WellKnownImports() {
+			final, err := writeFile(*output, canonical.Filename(), []byte(canonical.String()))
+			if err != nil {
+				fmt.Printf("Failed to write %s: %v\n", final, err)
 			} else {
-				// Need to investigate further
+				fmt.Printf("Wrote canonical %s\n", final)
 			}
 		}
 	}
+
+	if *stubs {
+		for _, stub := range batch.Stubs() {
+			final, err := writeFile(*output, stub.Filename(), []byte(stub.String()))
+			if err != nil {
+				fmt.Printf("Failed to write stub %s: %v\n", final, err)
+			} else {
+				fmt.Printf("Wrote stub %s\n", final)
+			}
+		}
+	}
+
+	fmt.Printf("\nScanned %s: %d descriptors found\n", *file, len(results))
+	for _, line := range runtimeInfo.Summary() {
+		fmt.Printf("  %s\n", line)
+	}
+
+	unresolved := batch.Registry.UnresolvedImports()
+	if len(unresolved) > 0 {
+		fmt.Printf("\nImports not found in %s:\n", *file)
+		filenames := make([]string, 0, len(unresolved))
+		for filename := range unresolved {
+			filenames = append(filenames, filename)
+		}
+		sort.Strings(filenames)
+		for _, filename := range filenames {
+			fmt.Printf("  %s imports %s\n", filename, strings.Join(unresolved[filename], ", "))
+		}
+	}
 }
@@ -4,6 +4,7 @@ go 1.19
 
 require (
 	github.com/stretchr/testify v1.8.1
+	github.com/ulikunitz/xz v0.5.12
 	google.golang.org/protobuf v1.34.2
 )
 
@@ -0,0 +1,87 @@
+package protodump
+
+import (
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Batch is a set of definitions rendered against each other, e.g. all the
+// ones dumped from a binary
+type Batch struct {
+	// Definitions holds the definition of every file, in the order they were
+	// given, or nil when the file couldn't be parsed
+	Definitions []*ProtoDefinition
+	// Errors holds why the definitions that are nil couldn't be parsed
+	Errors []error
+	// Registry holds all files, see UnresolvedImports for the imports that
+	// aren't among them
+	Registry *Registry
+}
+
+// NewBatch builds files into a shared Registry in dependency order and
+// renders each of them against it, so types imported from another file of
+// the batch are resolved, and custom options are resolved with the
+// extensions of all files
+func NewBatch(files []*descriptorpb.FileDescriptorProto) *Batch {
+	return newBatch(files, make([]error, len(files)))
+}
+
+// NewBatchFromBytes is NewBatch for serialized FileDescriptorProtos
+func NewBatchFromBytes(payloads [][]byte) *Batch {
+	files := make([]*descriptorpb.FileDescriptorProto, len(payloads))
+	errs := make([]error, len(payloads))
+	for i, payload := range payloads {
+		files[i], errs[i] = unmarshalFileDescriptorProto(payload)
+	}
+	return newBatch(files, errs)
+}
+
+func newBatch(files []*descriptorpb.FileDescriptorProto, errs []error) *Batch {
+	var parsed []*descriptorpb.FileDescriptorProto
+	for _, file := range files {
+		if file != nil {
+			parsed = append(parsed, file)
+		}
+	}
+
+	batch := &Batch{
+		Definitions: make([]*ProtoDefinition, len(files)),
+		Errors:      errs,
+		Registry:    NewRegistry(parsed),
+	}
+	for i, file := range files {
+		if file == nil {
+			continue
+		}
+		if descriptor := batch.Registry.fileDescriptor(file); descriptor != nil {
+			batch.Definitions[i] = newDefinition(file, descriptor, batch.Registry)
+			continue
+		}
+
+		// Files that clash with another one, or can't be built against the
+		// files they import, are rendered on their own
+		definition, err := NewFromDescriptor(file)
+		if err != nil {
+			batch.Errors[i] = err
+			continue
+		}
+		definition.SetExtensionResolver(batch.Registry)
+		batch.Definitions[i] = definition
+	}
+	return batch
+}
+
+// WellKnownImports returns the canonical version of the well-known types
+// files the batch imports but doesn't include, see Registry.CanonicalImports
+func (b *Batch) WellKnownImports() []*ProtoDefinition {
+	var definitions []*ProtoDefinition
+	for _, path := range b.Registry.CanonicalImports() {
+		file, _ := WellKnownFile(path)
+		definition := newDefinition(protodesc.ToFileDescriptorProto(file), file, nil)
+		definition.SetHeader([]string{
+			"Canonical version bundled with protodump, " + path + " wasn't found in the dump.",
+		})
+		definitions = append(definitions, definition)
+	}
+	return definitions
+}
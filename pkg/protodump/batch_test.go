@@ -0,0 +1,60 @@
+package protodump
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestBatch(t *testing.T) {
+	dir := path.Join("testdata", "batch")
+	files, err := convertProtoToFileDescriptors(path.Join(dir, "main.proto"), "--proto_path="+dir, "--include_imports", "--include_source_info")
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 3) {
+		return
+	}
+
+	expected, err := os.ReadFile(path.Join(dir, "main.proto"))
+	assert.NoError(t, err)
+
+	batch := NewBatch(files)
+	assert.Empty(t, batch.Registry.UnresolvedImports())
+	assert.Equal(t, []error{nil, nil, nil}, batch.Errors)
+
+	// The package a.b of x.proto shadows b, which only shows with the
+	// imports resolved
+	var output strings.Builder
+	assert.NoError(t, batch.Definitions[2].Render(&output, RenderOptions{TypeNames: MinimalNames}))
+	assert.Equal(t, string(expected), output.String())
+
+	batch = NewBatch([]*descriptorpb.FileDescriptorProto{files[2]})
+	assert.Equal(t, map[string][]string{"main.proto": {"x.proto", "y.proto"}}, batch.Registry.UnresolvedImports())
+	assert.NotNil(t, batch.Definitions[0])
+}
+
+func TestBatchFromBytes(t *testing.T) {
+	batch := NewBatchFromBytes([][]byte{{0xff}})
+	assert.Nil(t, batch.Definitions[0])
+	assert.Error(t, batch.Errors[0])
+}
+
+func TestBatchMessageSet(t *testing.T) {
+	filePath := path.Join(FIXTURES, "message_set.proto2")
+	descriptor, err := convertProtoToFileDescriptor(filePath)
+	assert.NoError(t, err)
+	expected, err := os.ReadFile(filePath)
+	assert.NoError(t, err)
+
+	// MessageSets are registered like other files, rather than rendered on
+	// their own
+	batch := NewBatch([]*descriptorpb.FileDescriptorProto{descriptor})
+	assert.NotNil(t, batch.Registry.fileDescriptor(descriptor))
+	assert.NoError(t, batch.Errors[0])
+	if assert.NotNil(t, batch.Definitions[0]) {
+		assert.Equal(t, string(expected), batch.Definitions[0].String())
+	}
+}
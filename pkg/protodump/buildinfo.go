@@ -0,0 +1,199 @@
+package protodump
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"encoding/binary"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// buildInfoMagic starts the build info blob the Go linker embeds in binaries
+var buildInfoMagic = []byte("\xff Go buildinf:")
+
+// buildInfoHeaderLen is the size of the build info header, after which Go
+// 1.18+ stores the version and module info as length prefixed strings
+const buildInfoHeaderLen = 32
+
+// protobufRuntimes labels the modules that decide how descriptors are stored
+var protobufRuntimes = map[string]string{
+	"google.golang.org/protobuf": "protobuf-go APIv2",
+	"github.com/golang/protobuf": "golang/protobuf APIv1",
+	"github.com/gogo/protobuf":   "gogo/protobuf",
+}
+
+// protobufModules are modules related to protobuf without "proto" in their path
+var protobufModules = map[string]bool{
+	"google.golang.org/grpc":    true,
+	"connectrpc.com/connect":    true,
+	"github.com/twitchtv/twirp": true,
+}
+
+// generatorPattern matches version strings of protoc and its plugins
+var generatorPattern = regexp.MustCompile(`(?:protoc-gen-[a-z0-9-]+ v[0-9]+\.[0-9]+\.[0-9]+|(?:lib)?protoc +v?[0-9]+\.[0-9]+(?:\.[0-9]+)?)`)
+
+// Module is a Go module a binary was built with
+type Module struct {
+	Path    string
+	Version string
+	// Runtime names the protobuf runtime the module provides, if any
+	Runtime string
+}
+
+func (m Module) String() string {
+	s := m.Path + " " + m.Version
+	if m.Runtime != "" {
+		s += " (" + m.Runtime + ")"
+	}
+	return s
+}
+
+// RuntimeInfo describes the Go toolchain, protobuf runtime and code generators
+// a binary was built with
+type RuntimeInfo struct {
+	// GoVersion is the Go toolchain version, empty for non-Go binaries
+	GoVersion string
+	// MainModule is the main module of a Go binary
+	MainModule string
+	// Modules lists the protobuf related modules the binary depends on
+	Modules []Module
+	// Generators lists protoc and protoc plugin version strings found anywhere
+	// in the binary. It's a heuristic: the strings aren't tied to any
+	// descriptor and may come from unrelated text, e.g. log messages.
+	Generators []string
+}
+
+// Summary returns the runtime info as human readable lines
+func (ri *RuntimeInfo) Summary() []string {
+	var lines []string
+	if ri.GoVersion != "" {
+		line := "Go: " + ri.GoVersion
+		if ri.MainModule != "" {
+			line += ", main module " + ri.MainModule
+		}
+		lines = append(lines, line)
+	}
+	for _, module := range ri.Modules {
+		lines = append(lines, "Module: "+module.String())
+	}
+	if len(ri.Generators) > 0 {
+		lines = append(lines, "Possible generators (found anywhere in the binary): "+strings.Join(ri.Generators, ", "))
+	}
+	return lines
+}
+
+// ReadRuntimeInfo reads Go build info and generator version strings from data.
+// The build info is read with debug/buildinfo when data is a well formed
+// executable, and found by its magic otherwise, e.g. in unpacked UPX images.
+func ReadRuntimeInfo(data []byte) *RuntimeInfo {
+	ri := &RuntimeInfo{}
+
+	info, err := buildinfo.Read(bytes.NewReader(data))
+	if err != nil {
+		debugPrintf("Couldn't read Go build info: %v, searching for it\n", err)
+		info = findBuildInfo(data)
+	}
+	if info != nil {
+		ri.GoVersion = info.GoVersion
+		if info.Main.Path != "" {
+			ri.MainModule = strings.TrimSpace(info.Main.Path + " " + info.Main.Version)
+		}
+		for _, dep := range info.Deps {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			runtime := protobufRuntimes[dep.Path]
+			if runtime != "" || protobufModules[dep.Path] || strings.Contains(dep.Path, "proto") {
+				ri.Modules = append(ri.Modules, Module{Path: dep.Path, Version: dep.Version, Runtime: runtime})
+			}
+		}
+	}
+
+	ri.Generators = findGenerators(data)
+	return ri
+}
+
+// findBuildInfo looks for the build info blob by its magic. Only the inline
+// string format written by Go 1.18 and later is supported.
+func findBuildInfo(data []byte) *debug.BuildInfo {
+	for offset := 0; ; {
+		index := bytes.Index(data[offset:], buildInfoMagic)
+		if index == -1 {
+			return nil
+		}
+		start := offset + index
+		offset = start + 1
+
+		const flagsVersionInline = 0x2
+		if start+buildInfoHeaderLen > len(data) || data[start+len(buildInfoMagic)+1]&flagsVersionInline == 0 {
+			continue
+		}
+
+		rest := data[start+buildInfoHeaderLen:]
+		version, n := readBuildInfoString(rest)
+		if n <= 0 {
+			continue
+		}
+		modinfo, m := readBuildInfoString(rest[n:])
+		if m <= 0 {
+			continue
+		}
+
+		// The module info is wrapped in 16 byte sentinels
+		if len(modinfo) >= 33 && modinfo[len(modinfo)-17] == '\n' {
+			modinfo = modinfo[16 : len(modinfo)-16]
+		}
+		info, err := debug.ParseBuildInfo(modinfo)
+		if err != nil {
+			continue
+		}
+		info.GoVersion = version
+		return info
+	}
+}
+
+func readBuildInfoString(data []byte) (string, int) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > uint64(len(data)-n) {
+		return "", 0
+	}
+	return string(data[n : n+int(length)]), n + int(length)
+}
+
+// findGenerators returns the distinct protoc and plugin version strings
+// anywhere in data
+func findGenerators(data []byte) []string {
+	seen := make(map[string]bool)
+	for offset := 0; ; {
+		index := bytes.Index(data[offset:], []byte("protoc"))
+		if index == -1 {
+			break
+		}
+		start := offset + index
+		offset = start + 1
+
+		// The longest match we care about is well under 64 bytes
+		windowStart := start - 3
+		if windowStart < 0 {
+			windowStart = 0
+		}
+		windowEnd := start + 64
+		if windowEnd > len(data) {
+			windowEnd = len(data)
+		}
+		match := generatorPattern.Find(data[windowStart:windowEnd])
+		if match != nil {
+			// protoc-gen-go aligns the versions in its header with spaces
+			seen[strings.Join(strings.Fields(string(match)), " ")] = true
+		}
+	}
+
+	generators := make([]string, 0, len(seen))
+	for generator := range seen {
+		generators = append(generators, generator)
+	}
+	sort.Strings(generators)
+	return generators
+}
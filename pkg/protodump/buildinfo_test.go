@@ -0,0 +1,42 @@
+package protodump
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadRuntimeInfo(t *testing.T) {
+	executable, err := os.Executable()
+	assert.NoError(t, err)
+	data, err := os.ReadFile(executable)
+	assert.NoError(t, err)
+
+	protobuf := func(ri *RuntimeInfo) *Module {
+		for i, module := range ri.Modules {
+			if module.Path == "google.golang.org/protobuf" {
+				return &ri.Modules[i]
+			}
+		}
+		return nil
+	}
+
+	ri := ReadRuntimeInfo(data)
+	assert.NotEmpty(t, ri.GoVersion)
+	if assert.NotNil(t, protobuf(ri)) {
+		assert.Equal(t, "protobuf-go APIv2", protobuf(ri).Runtime)
+	}
+
+	// Without a usable executable header the build info is found by its magic
+	corrupted := append([]byte{}, data...)
+	copy(corrupted, "junk")
+	fallback := ReadRuntimeInfo(corrupted)
+	assert.Equal(t, ri.GoVersion, fallback.GoVersion)
+	assert.Equal(t, protobuf(ri), protobuf(fallback))
+
+	generators := findGenerators([]byte("\x00// protoc-gen-go v1.34.2\n// protoc        v5.27.1\x00libprotoc 28.1\x00protocol"))
+	assert.Equal(t, []string{"libprotoc 28.1", "protoc v5.27.1", "protoc-gen-go v1.34.2"}, generators)
+	assert.Equal(t, []string{"Possible generators (found anywhere in the binary): libprotoc 28.1, protoc v5.27.1, protoc-gen-go v1.34.2"},
+		(&RuntimeInfo{Generators: generators}).Summary())
+}
@@ -0,0 +1,71 @@
+package protodump
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Diagnostic is something the renderer couldn't represent faithfully
+type Diagnostic struct {
+	// Element is the full name of the declaration concerned, or the file's
+	// name for the file itself
+	Element string
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return d.Element + ": " + d.Message
+}
+
+// Diagnostics returns what the last render couldn't represent faithfully,
+// see RenderOptions.InlineWarnings to also write them in the output
+func (pd *ProtoDefinition) Diagnostics() []Diagnostic {
+	return pd.diagnostics
+}
+
+// warn records a diagnostic about element, which is written as a comment
+// with InlineWarnings. It is called right before the element is written.
+func (pd *ProtoDefinition) warn(element string, format string, args ...interface{}) {
+	diagnostic := Diagnostic{Element: element, Message: fmt.Sprintf(format, args...)}
+	pd.diagnostics = append(pd.diagnostics, diagnostic)
+	if pd.options.InlineWarnings {
+		pd.writeIndented("// protodump: warning: ")
+		pd.write(diagnostic.Message)
+		pd.write("\n")
+	}
+}
+
+// warnEntries warns about the entries of element that are written as
+// comments, because they aren't understood
+func (pd *ProtoDefinition) warnEntries(element string, entries []optionEntry) {
+	for _, entry := range entries {
+		if entry.descriptor {
+			pd.warn(element, "descriptor field %s is unknown and only kept as a comment", entry.name)
+		} else if entry.raw {
+			pd.warn(element, "option %s couldn't be resolved and is only kept as a comment", entry.name)
+		}
+		for _, unknown := range entry.unknown {
+			pd.warn(element, "field %s of option %s is unknown and only kept as a comment", unknown, entry.name)
+		}
+	}
+}
+
+// warnType warns when the type referenced by element couldn't be resolved,
+// its kind is then only known from the descriptor
+func (pd *ProtoDefinition) warnType(element protoreflect.FullName, referenced protoreflect.Descriptor) {
+	if referenced != nil && referenced.IsPlaceholder() {
+		pd.warn(string(element), "type .%s couldn't be resolved", referenced.FullName())
+	}
+}
+
+// warnRanges warns about the ranges of message that can't be written as they
+// are, whose end is exclusive
+func (pd *ProtoDefinition) warnRanges(message protoreflect.FullName, kind string, ranges protoreflect.FieldRanges) {
+	for i := 0; i < ranges.Len(); i++ {
+		fieldRange := ranges.Get(i)
+		if fieldRange[1] <= fieldRange[0] {
+			pd.warn(string(message), "%s range [%d, %d) is empty and written as %s", kind, fieldRange[0], fieldRange[1], formatFieldRange(fieldRange))
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package protodump
+
+import (
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestDiagnostics(t *testing.T) {
+	descriptor, err := convertProtoToFileDescriptor(path.Join("testdata", "render_options.proto"))
+	assert.NoError(t, err)
+
+	// An unknown descriptor field, a type missing from the dump and an
+	// unknown custom option
+	request := descriptor.GetMessageType()[0]
+	unknown := protowire.AppendTag(nil, 102, protowire.VarintType)
+	request.GetField()[0].ProtoReflect().SetUnknown(protowire.AppendVarint(unknown, 3))
+	request.GetField()[1].TypeName = proto.String(".other.Missing")
+	descriptor.GetMessageType()[1].Options = &descriptorpb.MessageOptions{}
+	unknown = protowire.AppendTag(nil, 50000, protowire.VarintType)
+	descriptor.GetMessageType()[1].Options.ProtoReflect().SetUnknown(protowire.AppendVarint(unknown, 6))
+
+	actual, err := NewFromDescriptor(descriptor)
+	assert.NoError(t, err)
+	expected := []Diagnostic{
+		{Element: "hello.world.HelloRequest.name", Message: "descriptor field (102) is unknown and only kept as a comment"},
+		{Element: "hello.world.HelloRequest.test", Message: "type .other.Missing couldn't be resolved"},
+		{Element: "hello.world.HelloReply", Message: "option (50000) couldn't be resolved and is only kept as a comment"},
+	}
+	assert.Equal(t, expected, actual.Diagnostics())
+	assert.Equal(t, "hello.world.HelloRequest.test: type .other.Missing couldn't be resolved", actual.Diagnostics()[1].String())
+	assert.NotContains(t, actual.String(), "protodump: warning")
+
+	var rendered strings.Builder
+	assert.NoError(t, actual.Render(&rendered, RenderOptions{InlineWarnings: true}))
+	assert.Equal(t, expected, actual.Diagnostics())
+	output := rendered.String()
+	assert.Contains(t, output, "  // protodump: warning: descriptor field (102) is unknown and only kept as a comment\n  string name = 3")
+	assert.Contains(t, output, "  // protodump: warning: type .other.Missing couldn't be resolved\n  .other.Missing test = 1;")
+	assert.Contains(t, output, "message HelloReply {\n  // protodump: warning: option (50000) couldn't be resolved and is only kept as a comment\n")
+	// The options of Render don't carry over to String
+	assert.NotContains(t, actual.String(), "protodump: warning")
+}
+
+func TestExtensionRangeWarnings(t *testing.T) {
+	descriptor, err := convertProtoToFileDescriptor(path.Join("testdata", "extension_ranges.proto"), "--include_source_info")
+	assert.NoError(t, err)
+
+	// The output is checked by the extension_ranges.warnings.golden case of
+	// TestGolden
+	actual, err := NewFromDescriptor(descriptor)
+	assert.NoError(t, err)
+	assert.Equal(t, []Diagnostic{
+		{Element: "hello.world.label", Message: "type .google.protobuf.ExtensionRangeOptions couldn't be resolved"},
+		{Element: "hello.world.Extendable", Message: "option (50010) couldn't be resolved and is only kept as a comment"},
+	}, actual.Diagnostics())
+}
@@ -0,0 +1,145 @@
+package protodump
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"go/token"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// maxSymbolLen bounds how far back a symbol name is looked for
+const maxSymbolLen = 1024
+
+// Generated Go code names its per-file identifiers after the descriptor path:
+// protoc-gen-go APIv2 uses file_<path>_init, file_<path>_rawDesc and friends,
+// while golang/protobuf v1 and gogo use fileDescriptor_<hash of path>. Both
+// show up as "<import path>.<identifier>" in the pclntab function names and,
+// for unstripped binaries, in the symbol table.
+var goSymbolMarkers = [][]byte{[]byte(".file_"), []byte(".File_"), []byte(".fileDescriptor_")}
+
+// GoPackageIndex maps descriptor filenames to the Go package that registered
+// them, recovered from symbol and function names in a Go binary
+type GoPackageIndex struct {
+	packages map[string]string // generated identifier -> import path
+}
+
+// goSanitized mirrors strs.GoSanitized from protobuf-go, which protoc-gen-go
+// uses to turn descriptor paths into identifiers
+func goSanitized(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, s)
+
+	r, _ := utf8.DecodeRuneInString(s)
+	if token.Lookup(s).IsKeyword() || !unicode.IsLetter(r) {
+		return "_" + s
+	}
+	return s
+}
+
+// goFileIdent returns the identifier protoc-gen-go APIv2 derives from filename
+func goFileIdent(filename string) string {
+	return "file_" + goSanitized(filename)
+}
+
+// goLegacyFileIdent returns the identifier golang/protobuf v1 derives from filename
+func goLegacyFileIdent(filename string) string {
+	hash := sha256.Sum256([]byte(filename))
+	return "fileDescriptor_" + hex.EncodeToString(hash[:8])
+}
+
+// FindGoPackages builds a GoPackageIndex from the symbol and function names in data
+func FindGoPackages(data []byte) *GoPackageIndex {
+	gi := &GoPackageIndex{packages: make(map[string]string)}
+	for _, marker := range goSymbolMarkers {
+		for offset := 0; ; {
+			index := bytes.Index(data[offset:], marker)
+			if index == -1 {
+				break
+			}
+			dot := offset + index
+			offset = dot + 1
+
+			importPath, ident := goSymbolAt(data, dot)
+			if importPath == "" {
+				continue
+			}
+			if strings.HasPrefix(ident, "File_") {
+				// The exported descriptor variable, File_<path>
+				ident = "f" + ident[1:]
+			} else if strings.HasPrefix(ident, "file_") {
+				// Strip the _init, _rawDesc, ... suffix
+				ident = ident[:strings.LastIndexByte(ident, '_')]
+			}
+			gi.add(ident, importPath)
+		}
+	}
+	debugPrintf("Found %d Go packages registering descriptors\n", len(gi.packages))
+	return gi
+}
+
+// goSymbolAt extracts the symbol name around the dot at position dot, which is
+// delimited by non-printable bytes, and splits it into import path and identifier
+func goSymbolAt(data []byte, dot int) (string, string) {
+	start := dot
+	for start > 0 && dot-start < maxSymbolLen && isPrintable(data[start-1]) {
+		start--
+	}
+	end := dot + 1
+	for end < len(data) && end-dot < maxSymbolLen && isPrintable(data[end]) {
+		end++
+	}
+
+	importPath := string(data[start:dot])
+	ident := string(data[dot+1 : end])
+	// Closures and methods hang off the identifier, e.g. file_x_proto_init.func1
+	if index := strings.IndexByte(ident, '.'); index != -1 {
+		ident = ident[:index]
+	}
+	if importPath == "" || strings.ContainsAny(importPath, " \"'`\\") || strings.ContainsAny(ident, " ") {
+		return "", ""
+	}
+	// Mach-O prefixes symbols with an underscore
+	importPath = strings.TrimPrefix(importPath, "_")
+	// The linker escapes dots in the last path element
+	importPath = strings.ReplaceAll(importPath, "%2e", ".")
+	return importPath, ident
+}
+
+func (gi *GoPackageIndex) add(ident string, importPath string) {
+	if existing, ok := gi.packages[ident]; ok && existing != importPath {
+		debugPrintf("Identifier %s is defined by both %s and %s, keeping the former\n", ident, existing, importPath)
+		return
+	}
+	gi.packages[ident] = importPath
+}
+
+// Lookup returns the import path of the Go package that registered the
+// descriptor with the given filename, or "" if unknown
+func (gi *GoPackageIndex) Lookup(filename string) string {
+	if importPath, ok := gi.packages[goFileIdent(filename)]; ok {
+		return importPath
+	}
+	return gi.packages[goLegacyFileIdent(filename)]
+}
+
+// descriptorName returns the name (Field 1) of a serialized FileDescriptorProto
+func descriptorName(data []byte) string {
+	number, wireType, n := protowire.ConsumeTag(data)
+	if n < 0 || number != 1 || wireType != protowire.BytesType {
+		return ""
+	}
+	name, m := protowire.ConsumeBytes(data[n:])
+	if m < 0 {
+		return ""
+	}
+	return string(name)
+}
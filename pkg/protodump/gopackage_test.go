@@ -0,0 +1,45 @@
+package protodump
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestFindGoPackages(t *testing.T) {
+	executable, err := os.Executable()
+	assert.NoError(t, err)
+	data, err := os.ReadFile(executable)
+	assert.NoError(t, err)
+
+	packages := FindGoPackages(data)
+	assert.Equal(t, "google.golang.org/protobuf/types/descriptorpb", packages.Lookup("google/protobuf/descriptor.proto"))
+	assert.Equal(t, "", packages.Lookup("not/linked.proto"))
+
+	symbols := strings.Join([]string{
+		"example.com/agent/api%2ev1.file_api_v1_agent_proto_init.func1",
+		"_example.com/x/pb.File_x_1_proto",
+		"example.com/legacy/pb." + goLegacyFileIdent("legacy/old.proto"),
+	}, "\x00")
+	packages = FindGoPackages([]byte("\x00" + symbols + "\x00"))
+	assert.Equal(t, "example.com/agent/api.v1", packages.Lookup("api/v1/agent.proto"))
+	assert.Equal(t, "example.com/x/pb", packages.Lookup("x/1.proto"))
+	assert.Equal(t, "example.com/legacy/pb", packages.Lookup("legacy/old.proto"))
+}
+
+func TestRestoreGoPackage(t *testing.T) {
+	pd, err := NewFromDescriptor(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("x/foo.proto"),
+		Package: proto.String("x"),
+		Syntax:  proto.String("proto3"),
+	})
+	assert.NoError(t, err)
+
+	assert.True(t, pd.RestoreGoPackage("example.com/x/pb"))
+	assert.Equal(t, "syntax = \"proto3\";\n\npackage x;\n\noption go_package = \"example.com/x/pb\";\n\n", pd.String())
+	assert.False(t, pd.RestoreGoPackage("example.com/other"))
+}
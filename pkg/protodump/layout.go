@@ -0,0 +1,117 @@
+package protodump
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"fmt"
+	"sort"
+)
+
+// region is a named span of an executable, a section or a symbol
+type region struct {
+	name   string
+	offset int
+	// size is zero for symbols of formats that don't record it
+	size int
+}
+
+// layout maps file offsets of an executable to its sections and symbols
+type layout struct {
+	sections []region
+	// symbols are sorted by offset
+	symbols []region
+}
+
+// readLayout reads the sections and symbols of the ELF, Mach-O or PE
+// executable in data. The layout is empty for other inputs.
+func readLayout(data []byte) *layout {
+	l := &layout{}
+	if f, err := elf.NewFile(bytes.NewReader(data)); err == nil {
+		for _, section := range f.Sections {
+			if section.Type != elf.SHT_NOBITS && section.Name != "" {
+				l.sections = append(l.sections, region{name: section.Name, offset: int(section.Offset), size: int(section.FileSize)})
+			}
+		}
+		// Stripped binaries have no symbol table
+		symbols, _ := f.Symbols()
+		for _, symbol := range symbols {
+			if symbol.Section == elf.SHN_UNDEF || int(symbol.Section) >= len(f.Sections) || symbol.Size == 0 {
+				continue
+			}
+			section := f.Sections[symbol.Section]
+			if section.Type == elf.SHT_NOBITS || symbol.Value < section.Addr {
+				continue
+			}
+			offset := section.Offset + symbol.Value - section.Addr
+			l.symbols = append(l.symbols, region{name: symbol.Name, offset: int(offset), size: int(symbol.Size)})
+		}
+	} else if f, err := macho.NewFile(bytes.NewReader(data)); err == nil {
+		for _, section := range f.Sections {
+			// Zero filled sections take no space in the file
+			if section.Offset != 0 {
+				l.sections = append(l.sections, region{name: section.Seg + "," + section.Name, offset: int(section.Offset), size: int(section.Size)})
+			}
+		}
+		if f.Symtab != nil {
+			for _, symbol := range f.Symtab.Syms {
+				if symbol.Sect == 0 || int(symbol.Sect) > len(f.Sections) {
+					continue
+				}
+				section := f.Sections[symbol.Sect-1]
+				if section.Offset == 0 || symbol.Value < section.Addr {
+					continue
+				}
+				offset := uint64(section.Offset) + symbol.Value - section.Addr
+				l.symbols = append(l.symbols, region{name: symbol.Name, offset: int(offset)})
+			}
+		}
+	} else if f, err := pe.NewFile(bytes.NewReader(data)); err == nil {
+		for _, section := range f.Sections {
+			l.sections = append(l.sections, region{name: section.Name, offset: int(section.Offset), size: int(section.Size)})
+		}
+		for _, symbol := range f.Symbols {
+			if symbol.SectionNumber <= 0 || int(symbol.SectionNumber) > len(f.Sections) {
+				continue
+			}
+			section := f.Sections[symbol.SectionNumber-1]
+			l.symbols = append(l.symbols, region{name: symbol.Name, offset: int(section.Offset + symbol.Value)})
+		}
+	}
+	sort.SliceStable(l.symbols, func(i, j int) bool {
+		return l.symbols[i].offset < l.symbols[j].offset
+	})
+	return l
+}
+
+// locate describes where offset lies, e.g. `section .rodata, symbol
+// main.rawDesc+0x10`, or returns an empty string when it's outside of every
+// section. Without symbol sizes, the closest symbol before offset is taken.
+func (l *layout) locate(offset int) string {
+	var section *region
+	for i := range l.sections {
+		if offset >= l.sections[i].offset && offset < l.sections[i].offset+l.sections[i].size {
+			section = &l.sections[i]
+			break
+		}
+	}
+	if section == nil {
+		return ""
+	}
+	location := "section " + section.name
+
+	i := sort.Search(len(l.symbols), func(i int) bool {
+		return l.symbols[i].offset > offset
+	}) - 1
+	if i >= 0 {
+		symbol := l.symbols[i]
+		if symbol.offset >= section.offset && (symbol.size == 0 || offset < symbol.offset+symbol.size) {
+			location += ", symbol " + symbol.name
+			if offset > symbol.offset {
+				location += fmt.Sprintf("+0x%x", offset-symbol.offset)
+			}
+		}
+	}
+	return location
+}
@@ -0,0 +1,39 @@
+package protodump
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayout(t *testing.T) {
+	executable, err := os.Executable()
+	assert.NoError(t, err)
+	data, err := os.ReadFile(executable)
+	assert.NoError(t, err)
+
+	var found *Result
+	results := ScanResults(data)
+	for i := range results {
+		if descriptorName(results[i].Data) == "google/protobuf/descriptor.proto" {
+			found = &results[i]
+			break
+		}
+	}
+	if assert.NotNil(t, found) {
+		assert.Regexp(t, `^section [^ ,]+(, symbol \S+?(\+0x[0-9a-f]+)?)?$`, found.Location)
+	}
+
+	l := &layout{
+		sections: []region{{name: ".rodata", offset: 0x100, size: 0x100}},
+		symbols:  []region{{name: "main.a", offset: 0x110, size: 0x10}, {name: "main.b", offset: 0x180}},
+	}
+	assert.Equal(t, "", l.locate(0x80))
+	assert.Equal(t, "section .rodata", l.locate(0x100))
+	assert.Equal(t, "section .rodata, symbol main.a", l.locate(0x110))
+	assert.Equal(t, "section .rodata, symbol main.a+0x4", l.locate(0x114))
+	assert.Equal(t, "section .rodata", l.locate(0x120))
+	assert.Equal(t, "section .rodata, symbol main.b+0x20", l.locate(0x1a0))
+	assert.Equal(t, "", readLayout(descriptorBytes(t)).locate(0))
+}
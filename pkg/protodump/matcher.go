@@ -0,0 +1,78 @@
+package protodump
+
+// matcher is an Aho-Corasick automaton over a small, fixed set of byte
+// patterns. It lets the scanner look for every anchor in a single forward pass,
+// independent of how many anchors there are or how often they occur.
+type matcher struct {
+	next [][256]int32 // next[state][b] is the state after reading b
+	out  [][]int      // out[state] lists the patterns ending at state
+	lens []int        // lens[i] is the length of pattern i
+}
+
+func newMatcher(patterns ...[]byte) *matcher {
+	m := &matcher{
+		next: make([][256]int32, 1),
+		out:  make([][]int, 1),
+		lens: make([]int, len(patterns)),
+	}
+
+	// Build the trie, using -1 for missing edges
+	for i := range m.next[0] {
+		m.next[0][i] = -1
+	}
+	for id, pattern := range patterns {
+		m.lens[id] = len(pattern)
+		state := int32(0)
+		for _, b := range pattern {
+			if m.next[state][b] == -1 {
+				var edges [256]int32
+				for i := range edges {
+					edges[i] = -1
+				}
+				m.next = append(m.next, edges)
+				m.out = append(m.out, nil)
+				m.next[state][b] = int32(len(m.next) - 1)
+			}
+			state = m.next[state][b]
+		}
+		m.out[state] = append(m.out[state], id)
+	}
+
+	// Turn the trie into a DFA breadth-first, following failure links for
+	// missing edges and inheriting the outputs of the failure state
+	fail := make([]int32, len(m.next))
+	queue := make([]int32, 0, len(m.next))
+	for b := 0; b < 256; b++ {
+		if m.next[0][b] == -1 {
+			m.next[0][b] = 0
+		} else {
+			queue = append(queue, m.next[0][b])
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		m.out[state] = append(m.out[state], m.out[fail[state]]...)
+		for b := 0; b < 256; b++ {
+			child := m.next[state][b]
+			if child == -1 {
+				m.next[state][b] = m.next[fail[state]][b]
+				continue
+			}
+			fail[child] = m.next[fail[state]][b]
+			queue = append(queue, child)
+		}
+	}
+
+	return m
+}
+
+// step advances the automaton from state by one byte
+func (m *matcher) step(state int32, b byte) int32 {
+	return m.next[state][b]
+}
+
+// matches returns the ids of the patterns that end at state
+func (m *matcher) matches(state int32) []int {
+	return m.out[state]
+}
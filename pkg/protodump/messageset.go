@@ -0,0 +1,55 @@
+package protodump
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// buildFile builds the descriptor of file, with imports resolved by
+// resolver. protodesc rejects MessageSets, a legacy proto1 wire format that
+// only some old Google protos still use, so they are built without their
+// message_set_wire_format option, which messageOptions restores. Their
+// extension ranges may go past the regular max, which they are cut to and
+// written as `max` again.
+func buildFile(file *descriptorpb.FileDescriptorProto, resolver protodesc.Resolver) (protoreflect.FileDescriptor, error) {
+	if len(messageSets(file.GetMessageType())) > 0 {
+		file = proto.Clone(file).(*descriptorpb.FileDescriptorProto)
+		for _, message := range messageSets(file.GetMessageType()) {
+			message.Options.MessageSetWireFormat = nil
+			for _, extensionRange := range message.GetExtensionRange() {
+				if extensionRange.GetEnd() > int32(protowire.MaxValidNumber)+1 {
+					extensionRange.End = proto.Int32(int32(protowire.MaxValidNumber) + 1)
+				}
+			}
+		}
+	}
+	fileOptions := protodesc.FileOptions{AllowUnresolvable: true}
+	return fileOptions.New(file, resolver)
+}
+
+// messageSets returns the messages, nested ones included, that use the
+// MessageSet wire format
+func messageSets(messages []*descriptorpb.DescriptorProto) []*descriptorpb.DescriptorProto {
+	var sets []*descriptorpb.DescriptorProto
+	for _, message := range messages {
+		if message.GetOptions().GetMessageSetWireFormat() {
+			sets = append(sets, message)
+		}
+		sets = append(sets, messageSets(message.GetNestedType())...)
+	}
+	return sets
+}
+
+// messageOptions returns the options of the message at msgPath as declared,
+// including message_set_wire_format that buildFile leaves out of message
+func (pd *ProtoDefinition) messageOptions(message protoreflect.MessageDescriptor, msgPath []int32) proto.Message {
+	if declared := pd.protoAt(msgPath); declared != nil {
+		if pb, ok := declared.Interface().(*descriptorpb.DescriptorProto); ok && pb.GetOptions().GetMessageSetWireFormat() {
+			return pb.GetOptions()
+		}
+	}
+	return message.Options()
+}
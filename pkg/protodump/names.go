@@ -0,0 +1,182 @@
+package protodump
+
+import (
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// symbolKind classifies the names type references are resolved against
+type symbolKind int
+
+const (
+	// otherSymbol is a field, oneof, enum value, extension or method, which
+	// can't be referenced as a type but still shadows type names
+	otherSymbol symbolKind = iota
+	// typeSymbol is a message or enum
+	typeSymbol
+	// scopeSymbol is a package, a service, or a message only known from the
+	// names declared in it, which only contains other names
+	scopeSymbol
+)
+
+// isAggregate reports whether names can be looked up within the symbol
+func (kind symbolKind) isAggregate() bool {
+	return kind != otherSymbol
+}
+
+// buildSymbols collects the names visible to the file: its own declarations,
+// those of its imports, and the types it references along with their
+// enclosing scopes, which covers imports that couldn't be resolved
+func (pd *ProtoDefinition) buildSymbols() {
+	pd.symbols = make(map[protoreflect.FullName]symbolKind)
+	visited := make(map[string]bool)
+	var addFile func(file protoreflect.FileDescriptor)
+	addFile = func(file protoreflect.FileDescriptor) {
+		if visited[file.Path()] {
+			return
+		}
+		visited[file.Path()] = true
+		pd.addScopes(file.Package())
+		if file.Package() != "" {
+			pd.symbols[file.Package()] = scopeSymbol
+		}
+		pd.addMessages(file.Messages())
+		pd.addEnums(file.Enums())
+		pd.addExtensions(file.Extensions())
+		for i := 0; i < file.Services().Len(); i++ {
+			service := file.Services().Get(i)
+			pd.symbols[service.FullName()] = scopeSymbol
+			for j := 0; j < service.Methods().Len(); j++ {
+				method := service.Methods().Get(j)
+				pd.symbols[method.FullName()] = otherSymbol
+				pd.addReference(method.Input().FullName())
+				pd.addReference(method.Output().FullName())
+			}
+		}
+		for i := 0; i < file.Imports().Len(); i++ {
+			addFile(file.Imports().Get(i).FileDescriptor)
+		}
+	}
+	addFile(pd.descriptor)
+}
+
+func (pd *ProtoDefinition) addMessages(messages protoreflect.MessageDescriptors) {
+	for i := 0; i < messages.Len(); i++ {
+		message := messages.Get(i)
+		pd.symbols[message.FullName()] = typeSymbol
+		for j := 0; j < message.Fields().Len(); j++ {
+			pd.addField(message.Fields().Get(j))
+		}
+		for j := 0; j < message.Oneofs().Len(); j++ {
+			pd.symbols[message.Oneofs().Get(j).FullName()] = otherSymbol
+		}
+		pd.addMessages(message.Messages())
+		pd.addEnums(message.Enums())
+		pd.addExtensions(message.Extensions())
+	}
+}
+
+func (pd *ProtoDefinition) addEnums(enums protoreflect.EnumDescriptors) {
+	for i := 0; i < enums.Len(); i++ {
+		enum := enums.Get(i)
+		pd.symbols[enum.FullName()] = typeSymbol
+		// Enum values are siblings of their enum, as in C++
+		for j := 0; j < enum.Values().Len(); j++ {
+			pd.symbols[enum.Values().Get(j).FullName()] = otherSymbol
+		}
+	}
+}
+
+func (pd *ProtoDefinition) addExtensions(extensions protoreflect.ExtensionDescriptors) {
+	for i := 0; i < extensions.Len(); i++ {
+		extension := extensions.Get(i)
+		pd.addField(extension)
+		pd.addReference(extension.ContainingMessage().FullName())
+	}
+}
+
+func (pd *ProtoDefinition) addField(field protoreflect.FieldDescriptor) {
+	pd.symbols[field.FullName()] = otherSymbol
+	if field.Message() != nil {
+		pd.addReference(field.Message().FullName())
+	} else if field.Enum() != nil {
+		pd.addReference(field.Enum().FullName())
+	}
+}
+
+// addReference adds a referenced type, which may be declared in a file that
+// isn't available
+func (pd *ProtoDefinition) addReference(name protoreflect.FullName) {
+	pd.symbols[name] = typeSymbol
+	pd.addScopes(name.Parent())
+}
+
+// addScopes adds name and its parents, which are packages or messages
+func (pd *ProtoDefinition) addScopes(name protoreflect.FullName) {
+	for ; name != ""; name = name.Parent() {
+		if _, ok := pd.symbols[name]; !ok {
+			pd.symbols[name] = scopeSymbol
+		}
+	}
+}
+
+// minimalName returns the shortest name for the type name that resolves to it
+// when referenced from the element from, or the fully qualified name
+func (pd *ProtoDefinition) minimalName(name protoreflect.FullName, from protoreflect.FullName) string {
+	parts := strings.Split(string(name), ".")
+	for i := len(parts) - 1; i >= 0; i-- {
+		candidate := strings.Join(parts[i:], ".")
+		if pd.resolveName(candidate, from) == name {
+			return candidate
+		}
+	}
+	return "." + string(name)
+}
+
+// resolveName resolves a relative name like resolve, collecting the symbols
+// of the file first if needed
+func (pd *ProtoDefinition) resolveName(name string, relativeTo protoreflect.FullName) protoreflect.FullName {
+	if pd.symbols == nil {
+		pd.buildSymbols()
+	}
+	return pd.resolve(name, relativeTo)
+}
+
+// resolve looks up a relative name the way protoc does: in the scope of the
+// element relativeTo, then in each enclosing scope. The first scope holding
+// the first component of name decides, so nearer declarations shadow the
+// farther ones. A name that isn't a type is treated as not resolving, which
+// protoc only skips for field types.
+func (pd *ProtoDefinition) resolve(name string, relativeTo protoreflect.FullName) protoreflect.FullName {
+	firstPart := name
+	if dot := strings.IndexByte(name, '.'); dot >= 0 {
+		firstPart = name[:dot]
+	}
+
+	for scope := relativeTo.Parent(); ; scope = scope.Parent() {
+		candidate := protoreflect.FullName(firstPart)
+		if scope != "" {
+			candidate = scope + "." + candidate
+		}
+		kind, ok := pd.symbols[candidate]
+		if ok {
+			if firstPart != name {
+				if kind.isAggregate() {
+					resolved := candidate + protoreflect.FullName(name[len(firstPart):])
+					if pd.symbols[resolved] == typeSymbol {
+						return resolved
+					}
+					return ""
+				}
+			} else if kind == typeSymbol {
+				return candidate
+			} else {
+				return ""
+			}
+		}
+		if scope == "" {
+			return ""
+		}
+	}
+}
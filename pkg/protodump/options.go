@@ -0,0 +1,447 @@
+package protodump
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// uninterpretedOptionNumber is the uninterpreted_option field shared by all
+// options messages, which only protoc itself uses
+const uninterpretedOptionNumber = 999
+
+// featureSetName is the message holding the Editions feature settings in the
+// features field of every options message
+const featureSetName = "google.protobuf.FeatureSet"
+
+// optionEntry is a single `name = value` assignment of an options message
+type optionEntry struct {
+	name  string
+	value string
+	// raw marks unknown fields, whose value is dumped from the wire format
+	raw bool
+	// descriptor marks unknown fields of the descriptor itself, rather than
+	// of its options
+	descriptor bool
+	// path locates the option in SourceCodeInfo, relative to its options message
+	path []int32
+	// unknown names the unknown fields within an aggregate value, which are
+	// only kept as comments in it
+	unknown []string
+}
+
+// optionEntries flattens the populated fields of an options message into
+// assignments, in field number order. Repeated fields yield one assignment
+// per element, which is how they are written in .proto files.
+func (pd *ProtoDefinition) optionEntries(options proto.Message) []optionEntry {
+	if options == nil || !options.ProtoReflect().IsValid() {
+		return nil
+	}
+	message := pd.resolveOptions(options).ProtoReflect()
+
+	var fields []protoreflect.FieldDescriptor
+	message.Range(func(field protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		if field.Number() != uninterpretedOptionNumber {
+			fields = append(fields, field)
+		}
+		return true
+	})
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Number() < fields[j].Number()
+	})
+
+	var entries []optionEntry
+	for _, field := range fields {
+		name := string(field.Name())
+		if field.IsExtension() {
+			name = "(" + string(field.FullName()) + ")"
+		}
+		value := message.Get(field)
+		path := []int32{int32(field.Number())}
+		if field.Message() != nil && field.Message().FullName() == featureSetName {
+			entries = append(entries, featureEntries(name, value.Message(), path)...)
+			continue
+		}
+		if field.IsList() {
+			list := value.List()
+			for i := 0; i < list.Len(); i++ {
+				entries = append(entries, optionEntry{name: name, value: formatValue(field, list.Get(i)), path: path,
+					unknown: aggregateUnknown(field, list.Get(i), "")})
+			}
+		} else {
+			entries = append(entries, optionEntry{name: name, value: formatValue(field, value), path: path,
+				unknown: aggregateUnknown(field, value, "")})
+		}
+	}
+	return append(entries, rawEntries(message.GetUnknown())...)
+}
+
+// aggregateUnknown returns the names of the unknown fields within the value of
+// field if it's a message, e.g. `nested.(12)`, prefixed by prefix
+func aggregateUnknown(field protoreflect.FieldDescriptor, value protoreflect.Value, prefix string) []string {
+	if field.Message() == nil || field.IsMap() {
+		return nil
+	}
+	message := value.Message()
+	var names []string
+	for _, entry := range rawEntries(message.GetUnknown()) {
+		names = append(names, prefix+entry.name)
+	}
+	message.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		name := prefix + string(field.Name()) + "."
+		if field.IsExtension() {
+			name = prefix + "[" + string(field.FullName()) + "]."
+		}
+		if field.IsList() {
+			for i := 0; i < value.List().Len(); i++ {
+				names = append(names, aggregateUnknown(field, value.List().Get(i), name)...)
+			}
+		} else {
+			names = append(names, aggregateUnknown(field, value, name)...)
+		}
+		return true
+	})
+	return names
+}
+
+// resolveOptions parses the custom options in the unknown fields of options
+// with the extensions set by SetExtensionResolver, or the ones linked into
+// protodump when there are none
+func (pd *ProtoDefinition) resolveOptions(options proto.Message) proto.Message {
+	if len(options.ProtoReflect().GetUnknown()) == 0 {
+		return options
+	}
+	var resolver protoregistry.ExtensionTypeResolver = protoregistry.GlobalTypes
+	if pd.extensions != nil {
+		resolver = pd.extensions
+	}
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(options)
+	if err != nil {
+		return options
+	}
+	resolved := options.ProtoReflect().New().Interface()
+	if err := (proto.UnmarshalOptions{Resolver: resolver}).Unmarshal(data, resolved); err != nil {
+		debugPrintf("Couldn't resolve custom options: %v\n", err)
+		return options
+	}
+	return resolved
+}
+
+// rawEntries dumps unknown fields, which are custom options whose extension
+// isn't known, in the spirit of protoc --decode_raw
+func rawEntries(unknown protoreflect.RawFields) []optionEntry {
+	var entries []optionEntry
+	for len(unknown) > 0 {
+		number, wireType, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			return append(entries, optionEntry{name: "?", value: quote(unknown, false), raw: true})
+		}
+		m := protowire.ConsumeFieldValue(number, wireType, unknown[n:])
+		if m < 0 {
+			return append(entries, optionEntry{name: "?", value: quote(unknown, false), raw: true})
+		}
+		value := unknown[n : n+m]
+		unknown = unknown[n+m:]
+
+		var formatted string
+		switch wireType {
+		case protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			formatted = strconv.FormatUint(v, 10)
+		case protowire.Fixed32Type:
+			v, _ := protowire.ConsumeFixed32(value)
+			formatted = fmt.Sprintf("0x%08x", v)
+		case protowire.Fixed64Type:
+			v, _ := protowire.ConsumeFixed64(value)
+			formatted = fmt.Sprintf("0x%016x", v)
+		case protowire.BytesType:
+			v, _ := protowire.ConsumeBytes(value)
+			formatted = quote(v, false)
+		default:
+			formatted = quote(value, false)
+		}
+		entries = append(entries, optionEntry{name: "(" + strconv.Itoa(int(number)) + ")", value: formatted, raw: true, path: []int32{int32(number)}})
+	}
+	return entries
+}
+
+// featureExtensionsStart is the first field number of FeatureSet reserved for
+// language specific features
+const featureExtensionsStart = 1000
+
+// featureEntries flattens a FeatureSet into `features.<feature>` assignments,
+// which is how features are set in .proto files. Language specific features
+// are extensions, e.g. `features.(pb.cpp).legacy_closed_enum`.
+func featureEntries(prefix string, features protoreflect.Message, featuresPath []int32) []optionEntry {
+	var fields []protoreflect.FieldDescriptor
+	features.Range(func(field protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		fields = append(fields, field)
+		return true
+	})
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Number() < fields[j].Number()
+	})
+
+	var entries []optionEntry
+	for _, field := range fields {
+		value := features.Get(field)
+		path := append(append([]int32{}, featuresPath...), int32(field.Number()))
+		if field.IsExtension() {
+			entries = append(entries, featureEntries(prefix+".("+string(field.FullName())+")", value.Message(), path)...)
+			continue
+		}
+		name := prefix + "." + string(field.Name())
+		if field.IsList() {
+			list := value.List()
+			for i := 0; i < list.Len(); i++ {
+				entries = append(entries, optionEntry{name: name, value: formatValue(field, list.Get(i)), path: path})
+			}
+		} else {
+			entries = append(entries, optionEntry{name: name, value: formatValue(field, value), path: path})
+		}
+	}
+
+	// Features of a newer descriptor.proto, or language features whose
+	// extension isn't known
+	for _, entry := range rawEntries(features.GetUnknown()) {
+		entry.name = prefix + "." + entry.name
+		entry.descriptor = len(entry.path) > 0 && entry.path[0] < featureExtensionsStart
+		entry.path = append(append([]int32{}, featuresPath...), entry.path...)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// writeOptionStatements writes entries as option statements inside a block,
+// with the comments found under optionsPath, the path of the options message.
+// Unknown fields are commented out, as they can't be written as options.
+func (pd *ProtoDefinition) writeOptionStatements(entries []optionEntry, optionsPath []int32) {
+	for _, entry := range entries {
+		var info *CommentInfo
+		if !entry.raw {
+			info = pd.getComments(append(append([]int32{}, optionsPath...), entry.path...)...)
+		}
+		pd.writeLeadingCommentInfo(info)
+		if entry.descriptor {
+			pd.writeIndented("// unknown descriptor field ")
+		} else if entry.raw {
+			pd.writeIndented("// unresolved option ")
+		} else {
+			pd.writeIndented("option ")
+		}
+		pd.write(entry.name)
+		pd.write(" = ")
+		pd.write(entry.value)
+		pd.write(";")
+		pd.writeTrailingCommentInfo(info)
+		pd.write("\n")
+	}
+}
+
+// writeOptionList writes entries as the bracketed option list of a field,
+// enum value or extension range. Unknown fields follow as block comments.
+func (pd *ProtoDefinition) writeOptionList(entries []optionEntry) {
+	written := 0
+	for _, entry := range entries {
+		if entry.raw {
+			continue
+		}
+		if written == 0 {
+			pd.write(" [")
+		} else {
+			pd.write(", ")
+		}
+		pd.write(entry.name)
+		pd.write(" = ")
+		pd.write(entry.value)
+		written++
+	}
+	if written > 0 {
+		pd.write("]")
+	}
+
+	for _, entry := range entries {
+		if !entry.raw {
+			continue
+		}
+		if entry.descriptor {
+			pd.write(" /* unknown descriptor field ")
+		} else {
+			pd.write(" /* unresolved option ")
+		}
+		pd.write(entry.name)
+		pd.write(" = ")
+		pd.write(strings.ReplaceAll(entry.value, "*/", "*\\/"))
+		pd.write(" */")
+	}
+}
+
+// formatValue formats a singular value of field as a .proto literal
+func formatValue(field protoreflect.FieldDescriptor, value protoreflect.Value) string {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return strconv.FormatBool(value.Bool())
+	case protoreflect.EnumKind:
+		if enumValue := field.Enum().Values().ByNumber(value.Enum()); enumValue != nil {
+			return string(enumValue.Name())
+		}
+		return strconv.Itoa(int(value.Enum()))
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return strconv.FormatInt(value.Int(), 10)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return strconv.FormatUint(value.Uint(), 10)
+	case protoreflect.FloatKind:
+		return formatFloat(value.Float(), 32)
+	case protoreflect.DoubleKind:
+		return formatFloat(value.Float(), 64)
+	case protoreflect.StringKind:
+		return quote([]byte(value.String()), true)
+	case protoreflect.BytesKind:
+		return quote(value.Bytes(), false)
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return formatMessage(value.Message())
+	}
+	return value.String()
+}
+
+// formatFloat formats a float or double literal
+func formatFloat(f float64, bitSize int) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, bitSize)
+}
+
+// quote writes data as a .proto string literal. String values keep valid
+// UTF-8 sequences as is, everything else non-printable is octal escaped.
+func quote(data []byte, isString bool) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch c {
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case '\t':
+			b.WriteString("\\t")
+		case '"':
+			b.WriteString("\\\"")
+		case '\\':
+			b.WriteString("\\\\")
+		default:
+			if c >= 0x80 && isString {
+				if r, size := utf8.DecodeRune(data[i:]); r != utf8.RuneError || size > 1 {
+					b.Write(data[i : i+size])
+					i += size
+					continue
+				}
+			}
+			if isPrintable(c) {
+				b.WriteByte(c)
+			} else {
+				b.WriteByte('\\')
+				b.WriteString(strconv.FormatInt(int64(c)|0o1000, 8)[1:])
+			}
+		}
+		i++
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// formatMessage formats message in the text format used for aggregate option
+// values. Unlike prototext, the output is stable.
+func formatMessage(message protoreflect.Message) string {
+	var fields []protoreflect.FieldDescriptor
+	message.Range(func(field protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		fields = append(fields, field)
+		return true
+	})
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Number() < fields[j].Number()
+	})
+
+	var parts []string
+	for _, field := range fields {
+		name := string(field.Name())
+		if field.IsExtension() {
+			name = "[" + string(field.FullName()) + "]"
+		} else if field.Kind() == protoreflect.GroupKind {
+			name = string(field.Message().Name())
+		}
+
+		value := message.Get(field)
+		switch {
+		case field.IsMap():
+			entries := value.Map()
+			for _, key := range sortedMapKeys(entries) {
+				parts = append(parts, name+" { key: "+formatValue(field.MapKey(), key.Value())+
+					" value: "+formatValue(field.MapValue(), entries.Get(key))+" }")
+			}
+		case field.IsList():
+			list := value.List()
+			for i := 0; i < list.Len(); i++ {
+				parts = append(parts, formatField(name, field, list.Get(i)))
+			}
+		default:
+			parts = append(parts, formatField(name, field, value))
+		}
+	}
+
+	// protoc skips comments within aggregate values
+	for _, entry := range rawEntries(message.GetUnknown()) {
+		parts = append(parts, "/* unknown field "+entry.name+" = "+strings.ReplaceAll(entry.value, "*/", "*\\/")+" */")
+	}
+
+	if len(parts) == 0 {
+		return "{}"
+	}
+	return "{ " + strings.Join(parts, " ") + " }"
+}
+
+// sortedMapKeys returns the keys of m in ascending order, false before true
+func sortedMapKeys(m protoreflect.Map) []protoreflect.MapKey {
+	var keys []protoreflect.MapKey
+	m.Range(func(key protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		switch a := keys[i].Interface().(type) {
+		case bool:
+			return !a && keys[j].Bool()
+		case int32, int64:
+			return keys[i].Int() < keys[j].Int()
+		case uint32, uint64:
+			return keys[i].Uint() < keys[j].Uint()
+		default:
+			return keys[i].String() < keys[j].String()
+		}
+	})
+	return keys
+}
+
+func formatField(name string, field protoreflect.FieldDescriptor, value protoreflect.Value) string {
+	if field.Message() != nil {
+		return name + " " + formatValue(field, value)
+	}
+	return name + ": " + formatValue(field, value)
+}
@@ -2,14 +2,14 @@ package protodump
 
 import (
 	"fmt"
+	"math"
 	"path"
-	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
 	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
-	"google.golang.org/protobuf/reflect/protodesc"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
 	"google.golang.org/protobuf/types/descriptorpb"
@@ -20,6 +20,9 @@ type CommentInfo struct {
 	LeadingComments         string
 	TrailingComments        string
 	LeadingDetachedComments []string
+	// Span is the location's [start line, start column, end line, end column],
+	// the end line is omitted when it equals the start line
+	Span []int32
 }
 
 // pathKey converts a path slice to a string key for map lookup
@@ -38,11 +41,26 @@ type ProtoDefinition struct {
 	descriptor  protoreflect.FileDescriptor
 	filename    string
 	comments    map[string]*CommentInfo // path -> comments
+	// blockComments keeps every location of a path in source order, for
+	// paths like extend blocks that protoc records once per block
+	blockComments map[string][]*CommentInfo
+	header        []string
+	// extensions resolves custom options, see SetExtensionResolver
+	extensions protoregistry.ExtensionTypeResolver
+	// options configures the render in progress, see Render
+	options RenderOptions
+	// text is the output with the default options, see String
+	text string
+	// symbols holds the names visible to the file for MinimalNames
+	symbols map[protoreflect.FullName]symbolKind
+	// diagnostics are collected while rendering, see Diagnostics
+	diagnostics []Diagnostic
 }
 
 // buildCommentMap extracts all comments from SourceCodeInfo and builds a lookup map
 func (pd *ProtoDefinition) buildCommentMap() {
 	pd.comments = make(map[string]*CommentInfo)
+	pd.blockComments = make(map[string][]*CommentInfo)
 
 	sci := pd.pb.GetSourceCodeInfo()
 	if sci == nil {
@@ -51,11 +69,14 @@ func (pd *ProtoDefinition) buildCommentMap() {
 
 	for _, loc := range sci.GetLocation() {
 		key := pathKey(loc.GetPath())
-		pd.comments[key] = &CommentInfo{
+		info := &CommentInfo{
 			LeadingComments:         loc.GetLeadingComments(),
 			TrailingComments:        loc.GetTrailingComments(),
 			LeadingDetachedComments: loc.GetLeadingDetachedComments(),
+			Span:                    loc.GetSpan(),
 		}
+		pd.comments[key] = info
+		pd.blockComments[key] = append(pd.blockComments[key], info)
 	}
 }
 
@@ -69,8 +90,11 @@ func (pd *ProtoDefinition) getComments(path ...int32) *CommentInfo {
 
 // writeLeadingComments writes leading detached comments and leading comments
 func (pd *ProtoDefinition) writeLeadingComments(path ...int32) {
-	info := pd.getComments(path...)
-	if info == nil {
+	pd.writeLeadingCommentInfo(pd.getComments(path...))
+}
+
+func (pd *ProtoDefinition) writeLeadingCommentInfo(info *CommentInfo) {
+	if info == nil || pd.options.OmitComments {
 		return
 	}
 
@@ -88,20 +112,30 @@ func (pd *ProtoDefinition) writeLeadingComments(path ...int32) {
 
 // writeTrailingComment writes a trailing comment on the same line
 func (pd *ProtoDefinition) writeTrailingComment(path ...int32) {
-	info := pd.getComments(path...)
-	if info == nil || info.TrailingComments == "" {
+	pd.writeTrailingCommentInfo(pd.getComments(path...))
+}
+
+func (pd *ProtoDefinition) writeTrailingCommentInfo(info *CommentInfo) {
+	if info == nil || info.TrailingComments == "" || pd.options.OmitComments {
 		return
 	}
 
-	// Trailing comments are typically on the same line
-	comment := strings.TrimSpace(info.TrailingComments)
-	if comment != "" {
-		// Remove trailing newline and convert to single-line comment
-		comment = strings.TrimSuffix(comment, "\n")
-		if !strings.Contains(comment, "\n") {
-			pd.write(" //")
-			pd.write(comment)
+	// Single line trailing comments stay line comments, longer ones become a
+	// block comment so they can still follow the declaration
+	comment := strings.TrimSuffix(info.TrailingComments, "\n")
+	if strings.TrimSpace(comment) == "" {
+		return
+	}
+	if !strings.Contains(comment, "\n") {
+		pd.write(" //")
+		pd.write(comment)
+	} else {
+		pd.write(" /*")
+		pd.write(strings.ReplaceAll(comment, "*/", "* /"))
+		if !strings.HasSuffix(comment, " ") {
+			pd.write(" ")
 		}
+		pd.write("*/")
 	}
 }
 
@@ -131,7 +165,7 @@ func (pd *ProtoDefinition) dedent() {
 }
 
 func (pd *ProtoDefinition) writeIndented(s string) {
-	pd.builder.WriteString(strings.Repeat("  ", pd.indendation))
+	pd.builder.WriteString(strings.Repeat(pd.indentString(), pd.indendation))
 	pd.write(s)
 }
 
@@ -139,8 +173,62 @@ func (pd *ProtoDefinition) write(s string) {
 	pd.builder.WriteString(s)
 }
 
+// SetHeader sets lines written as a comment block at the top of the file,
+// e.g. to record where the definition was extracted from
+func (pd *ProtoDefinition) SetHeader(lines []string) {
+	pd.header = lines
+}
+
+// String returns the definition written with the default RenderOptions
 func (pd *ProtoDefinition) String() string {
-	return pd.builder.String()
+	return pd.withHeader(pd.text)
+}
+
+// withHeader prepends the header to the rendered text, see SetHeader
+func (pd *ProtoDefinition) withHeader(text string) string {
+	if len(pd.header) == 0 {
+		return text
+	}
+
+	var header strings.Builder
+	for _, line := range pd.header {
+		header.WriteString("// ")
+		header.WriteString(line)
+		header.WriteString("\n")
+	}
+	header.WriteString("\n")
+	return header.String() + text
+}
+
+// RestoreGoPackage sets the go_package option to importPath when the
+// descriptor doesn't have one, e.g. using the Go package recovered from the
+// binary's symbols. It reports whether the option was added.
+func (pd *ProtoDefinition) RestoreGoPackage(importPath string) bool {
+	if importPath == "" || pd.pb.GetOptions().GetGoPackage() != "" {
+		return false
+	}
+
+	pb := proto.Clone(pd.pb).(*descriptorpb.FileDescriptorProto)
+	if pb.Options == nil {
+		pb.Options = &descriptorpb.FileOptions{}
+	}
+	pb.Options.GoPackage = proto.String(importPath)
+	pd.pb = pb
+	pd.text = pd.render(RenderOptions{})
+	return true
+}
+
+// SetExtensionResolver sets where the extensions behind custom options are
+// looked up, typically a Registry of all descriptors dumped from the same
+// binary, and renders the file again
+func (pd *ProtoDefinition) SetExtensionResolver(resolver protoregistry.ExtensionTypeResolver) {
+	pd.extensions = resolver
+	pd.text = pd.render(RenderOptions{})
+}
+
+// FileDescriptorProto returns the descriptor the definition is rendered from
+func (pd *ProtoDefinition) FileDescriptorProto() *descriptorpb.FileDescriptorProto {
+	return pd.pb
 }
 
 func (pd *ProtoDefinition) Filename() string {
@@ -157,21 +245,31 @@ func (pd *ProtoDefinition) writeMethodWithPath(method protoreflect.MethodDescrip
 	methodPath := append(append([]int32{}, servicePath...), 2, int32(methodIdx)) // 2 = method field in ServiceDescriptorProto
 
 	pd.writeLeadingComments(methodPath...)
+	options := append(pd.optionEntries(method.Options()), pd.unknownEntries(methodPath...)...)
+	pd.warnType(method.FullName(), method.Input())
+	pd.warnType(method.FullName(), method.Output())
+	pd.warnEntries(string(method.FullName()), options)
 	pd.writeIndented("rpc ")
 	pd.write(string(method.Name()))
 	pd.write(" (")
 	if method.IsStreamingClient() {
 		pd.write("stream ")
 	}
-	pd.write(".")
-	pd.write(string(method.Input().FullName()))
+	pd.write(pd.typeName(method.Input().FullName(), method.FullName()))
 	pd.write(") returns (")
 	if method.IsStreamingServer() {
 		pd.write("stream ")
 	}
-	pd.write(".")
-	pd.write(string(method.Output().FullName()))
-	pd.write(") {}")
+	pd.write(pd.typeName(method.Output().FullName(), method.FullName()))
+	if len(options) > 0 {
+		pd.write(") {\n")
+		pd.indent()
+		pd.writeOptionStatements(options, append(append([]int32{}, methodPath...), 4)) // 4 = options field in MethodDescriptorProto
+		pd.dedent()
+		pd.writeIndented("}")
+	} else {
+		pd.write(") {}")
+	}
 	pd.writeTrailingComment(methodPath...)
 	pd.write("\n")
 }
@@ -184,14 +282,12 @@ func (pd *ProtoDefinition) writeMethod(method protoreflect.MethodDescriptor) {
 	if method.IsStreamingClient() {
 		pd.write("stream ")
 	}
-	pd.write(".")
-	pd.write(string(method.Input().FullName()))
+	pd.write(pd.typeName(method.Input().FullName(), method.FullName()))
 	pd.write(") returns (")
 	if method.IsStreamingServer() {
 		pd.write("stream ")
 	}
-	pd.write(".")
-	pd.write(string(method.Output().FullName()))
+	pd.write(pd.typeName(method.Output().FullName(), method.FullName()))
 	pd.write(") {}\n")
 }
 
@@ -203,11 +299,22 @@ func (pd *ProtoDefinition) writeServiceWithPath(service protoreflect.ServiceDesc
 	pd.write(string(service.Name()))
 	pd.write(" {\n")
 	pd.indent()
+	options := append(pd.optionEntries(service.Options()), pd.unknownEntries(servicePath...)...)
+	pd.warnEntries(string(service.FullName()), options)
+	pd.writeOptionStatements(options, append(append([]int32{}, servicePath...), 3)) // 3 = options field in ServiceDescriptorProto
+	var declarations []declaration
 	for i := 0; i < service.Methods().Len(); i++ {
-		pd.writeMethodWithPath(service.Methods().Get(i), servicePath, i)
+		method, i := service.Methods().Get(i), i
+		declarations = append(declarations, declaration{span: pd.spanAt(append(append([]int32{}, servicePath...), 2, int32(i))...),
+			kind: methodDeclaration, name: string(method.Name()), write: func() {
+				pd.writeMethodWithPath(method, servicePath, i)
+			}})
 	}
+	pd.writeDeclarations(declarations)
 	pd.dedent()
-	pd.writeIndented("}\n\n")
+	pd.writeIndented("}")
+	pd.writeTrailingComment(servicePath...)
+	pd.write("\n\n")
 }
 
 func (pd *ProtoDefinition) writeService(service protoreflect.ServiceDescriptor) {
@@ -226,18 +333,18 @@ func (pd *ProtoDefinition) writeService(service protoreflect.ServiceDescriptor)
 func (pd *ProtoDefinition) writeType(field protoreflect.FieldDescriptor) {
 	kind := field.Kind().String()
 
-	if kind == "message" {
-		pd.write(".")
-		pd.write(string(field.Message().FullName()))
-	} else if kind == "enum" {
-		pd.write(".")
-		pd.write(string(field.Enum().FullName()))
-	} else if kind == "map" {
+	// Map fields are repeated fields of a synthetic MapEntry message, which
+	// protoreflect reports as message kind
+	if field.IsMap() {
 		pd.write("map<")
 		pd.writeType(field.MapKey())
 		pd.write(", ")
 		pd.writeType(field.MapValue())
 		pd.write(">")
+	} else if kind == "message" || kind == "group" {
+		pd.write(pd.typeName(field.Message().FullName(), field.FullName()))
+	} else if kind == "enum" {
+		pd.write(pd.typeName(field.Enum().FullName(), field.FullName()))
 	} else {
 		pd.write(kind)
 	}
@@ -249,15 +356,21 @@ func (pd *ProtoDefinition) writeOneofWithPath(oneof protoreflect.OneofDescriptor
 	if oneof.IsSynthetic() {
 		// For synthetic oneofs (optional fields in proto3), just write the field
 		field := oneof.Fields().Get(0)
+		if oneof.Name() != "_"+field.Name() {
+			pd.warn(string(oneof.FullName()), "synthetic oneof is written as optional field %s, which protoc names _%s", field.Name(), field.Name())
+		}
 		fieldIdx := fieldIndexMap[string(field.Name())]
 		pd.writeFieldWithPath(field, msgPath, fieldIdx)
 	} else {
 		pd.writeLeadingComments(oneofPath...)
+		options := append(pd.optionEntries(oneof.Options()), pd.unknownEntries(oneofPath...)...)
+		pd.warnEntries(string(oneof.FullName()), options)
 		pd.writeIndented("")
 		pd.write("oneof ")
 		pd.write(string(oneof.Name()))
 		pd.write(" {\n")
 		pd.indent()
+		pd.writeOptionStatements(options, append(append([]int32{}, oneofPath...), 2)) // 2 = options field in OneofDescriptorProto
 		for i := 0; i < oneof.Fields().Len(); i++ {
 			field := oneof.Fields().Get(i)
 			fieldIdx := fieldIndexMap[string(field.Name())]
@@ -290,45 +403,220 @@ func (pd *ProtoDefinition) writeOneof(oneof protoreflect.OneofDescriptor) {
 
 func (pd *ProtoDefinition) writeFieldWithPath(field protoreflect.FieldDescriptor, msgPath []int32, fieldIdx int) {
 	fieldPath := append(append([]int32{}, msgPath...), 2, int32(fieldIdx)) // 2 = field in DescriptorProto
+	pd.writeFieldAtPath(field, fieldPath)
+}
 
+// writeFieldAtPath writes a field or extension whose comments live at fieldPath
+func (pd *ProtoDefinition) writeFieldAtPath(field protoreflect.FieldDescriptor, fieldPath []int32) {
 	pd.writeLeadingComments(fieldPath...)
+
+	var options []optionEntry
+	if field.HasDefault() {
+		var value string
+		if field.Kind() == protoreflect.EnumKind {
+			value = string(field.DefaultEnumValue().Name())
+		} else {
+			// Escapes strings and bytes, and spells special floats the way protoc parses them
+			value = formatValue(field, field.Default())
+		}
+		options = append(options, optionEntry{name: "default", value: value})
+	}
+	options = append(options, pd.fieldOptions(field, fieldPath)...)
+	options = append(options, pd.unknownEntries(fieldPath...)...)
+
+	typed := field
+	if field.IsMap() {
+		typed = field.MapValue()
+	}
+	pd.warnType(field.FullName(), typed.Message())
+	pd.warnType(field.FullName(), typed.Enum())
+	pd.warnEntries(string(field.FullName()), options)
+
 	pd.writeIndented("")
 	if field.HasOptionalKeyword() {
 		pd.write("optional ")
-	} else if field.Cardinality().String() == "repeated" {
+	} else if field.Cardinality().String() == "repeated" && !field.IsMap() {
 		pd.write("repeated ")
 	} else if field.Cardinality().String() == "required" && pd.descriptor.Syntax().String() == "proto2" {
 		pd.write("required ")
 	}
+	if isGroupField(field) {
+		pd.writeGroup(field, fieldPath, options)
+		return
+	}
 	pd.writeType(field)
 	pd.write(" ")
 	pd.write(string(field.Name()))
 	pd.write(" = ")
 	pd.write(strconv.Itoa(int(field.Number())))
-	if field.HasDefault() {
-		pd.write(" [default = ")
-		kind := field.Kind().String()
-		if kind == "string" {
-			pd.write(fmt.Sprintf("\"%s\"", field.Default().String()))
-		} else if kind == "enum" {
-			pd.write(string(field.DefaultEnumValue().Name()))
+	pd.writeOptionList(options)
+	pd.write(";")
+	pd.writeTrailingComment(fieldPath...)
+	pd.write("\n")
+}
+
+// fieldOptions returns the explicitly set options of a field, led by its
+// json_name when that isn't the default. Descriptors written by older protoc
+// versions may carry required and group fields of Editions files as labels
+// and types instead of features, which are turned back into the features
+// that produce them.
+func (pd *ProtoDefinition) fieldOptions(field protoreflect.FieldDescriptor, fieldPath []int32) []optionEntry {
+	var options []optionEntry
+	fieldProto := pd.fieldProto(fieldPath)
+	if fieldProto.JsonName != nil && !field.IsExtension() && fieldProto.GetJsonName() != jsonName(string(field.Name())) {
+		options = append(options, optionEntry{name: "json_name", value: quote([]byte(fieldProto.GetJsonName()), true)})
+	}
+	options = append(options, pd.optionEntries(field.Options())...)
+	if pd.descriptor.Syntax() != protoreflect.Editions {
+		return options
+	}
+
+	has := func(name string) bool {
+		for _, entry := range options {
+			if entry.name == name {
+				return true
+			}
+		}
+		return false
+	}
+	if fieldProto.GetLabel() == descriptorpb.FieldDescriptorProto_LABEL_REQUIRED && !has("features.field_presence") {
+		options = append(options, optionEntry{name: "features.field_presence", value: "LEGACY_REQUIRED"})
+	}
+	if fieldProto.GetType() == descriptorpb.FieldDescriptorProto_TYPE_GROUP && !has("features.message_encoding") {
+		options = append(options, optionEntry{name: "features.message_encoding", value: "DELIMITED"})
+	}
+	return options
+}
+
+// jsonName returns the JSON name protoc derives from a field name when no
+// json_name option is given
+func jsonName(name string) string {
+	var b strings.Builder
+	upper := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '_' {
+			upper = true
+		} else if upper && 'a' <= c && c <= 'z' {
+			b.WriteByte(c - 'a' + 'A')
+			upper = false
 		} else {
-			pd.write(field.Default().String())
+			b.WriteByte(c)
+			upper = false
 		}
+	}
+	return b.String()
+}
 
-		pd.write("]")
+// fieldProto returns the FieldDescriptorProto at a SourceCodeInfo path, or nil
+func (pd *ProtoDefinition) fieldProto(fieldPath []int32) *descriptorpb.FieldDescriptorProto {
+	if len(fieldPath) < 2 {
+		return nil
 	}
-	pd.write(";")
+	var message *descriptorpb.DescriptorProto
+	for i := 0; i < len(fieldPath)-2; i += 2 {
+		index := int(fieldPath[i+1])
+		switch {
+		case i == 0 && fieldPath[i] == 4 && index < len(pd.pb.GetMessageType()):
+			message = pd.pb.GetMessageType()[index]
+		case i > 0 && fieldPath[i] == 3 && index < len(message.GetNestedType()):
+			message = message.GetNestedType()[index]
+		default:
+			return nil
+		}
+	}
+
+	number, index := fieldPath[len(fieldPath)-2], int(fieldPath[len(fieldPath)-1])
+	var fields []*descriptorpb.FieldDescriptorProto
+	switch {
+	case message == nil && number == 7:
+		fields = pd.pb.GetExtension()
+	case message != nil && number == 2:
+		fields = message.GetField()
+	case message != nil && number == 6:
+		fields = message.GetExtension()
+	}
+	if index >= len(fields) {
+		return nil
+	}
+	return fields[index]
+}
+
+// writeGroup writes the rest of a group field after its label, with the
+// options and the group's message body inline
+func (pd *ProtoDefinition) writeGroup(field protoreflect.FieldDescriptor, fieldPath []int32, options []optionEntry) {
+	message := field.Message()
+	pd.write("group ")
+	pd.write(string(message.Name()))
+	pd.write(" = ")
+	pd.write(strconv.Itoa(int(field.Number())))
+	pd.writeOptionList(options)
+	pd.write(" {\n")
+	pd.indent()
+	pd.writeMessageBody(message, messagePath(message))
+	pd.dedent()
+	pd.writeIndented("}")
 	pd.writeTrailingComment(fieldPath...)
 	pd.write("\n")
 }
 
+// isGroupField reports whether field is a proto2 group, whose message is
+// declared alongside the field and named after it
+func isGroupField(field protoreflect.FieldDescriptor) bool {
+	// Editions files have delimited message fields instead
+	if field.Kind() != protoreflect.GroupKind || field.ParentFile().Syntax() != protoreflect.Proto2 {
+		return false
+	}
+	message := field.Message()
+	if message.IsPlaceholder() || message.Parent() == nil {
+		return false
+	}
+	// Parent is the containing message of a field and the declaring scope of an extension
+	return message.Parent().FullName() == field.Parent().FullName() &&
+		string(field.Name()) == strings.ToLower(string(message.Name()))
+}
+
+// isGroupMessage reports whether message belongs to a group field, in which
+// case it's written inline with the field
+func isGroupMessage(message protoreflect.MessageDescriptor) bool {
+	var fields []protoreflect.FieldDescriptor
+	switch parent := message.Parent().(type) {
+	case protoreflect.MessageDescriptor:
+		for i := 0; i < parent.Fields().Len(); i++ {
+			fields = append(fields, parent.Fields().Get(i))
+		}
+		for i := 0; i < parent.Extensions().Len(); i++ {
+			fields = append(fields, parent.Extensions().Get(i))
+		}
+	case protoreflect.FileDescriptor:
+		for i := 0; i < parent.Extensions().Len(); i++ {
+			fields = append(fields, parent.Extensions().Get(i))
+		}
+	}
+	for _, field := range fields {
+		if isGroupField(field) && field.Message().FullName() == message.FullName() {
+			return true
+		}
+	}
+	return false
+}
+
+// messagePath returns the SourceCodeInfo path of message
+func messagePath(message protoreflect.MessageDescriptor) []int32 {
+	if parent, ok := message.Parent().(protoreflect.MessageDescriptor); ok {
+		// 3 = nested_type field in DescriptorProto
+		return append(messagePath(parent), 3, int32(message.Index()))
+	}
+	// 4 = message_type field in FileDescriptorProto
+	return []int32{4, int32(message.Index())}
+}
+
 func (pd *ProtoDefinition) writeField(field protoreflect.FieldDescriptor) {
 	// Legacy method without path tracking
 	pd.writeIndented("")
 	if field.HasOptionalKeyword() {
 		pd.write("optional ")
-	} else if field.Cardinality().String() == "repeated" {
+	} else if field.Cardinality().String() == "repeated" && !field.IsMap() {
 		pd.write("repeated ")
 	} else if field.Cardinality().String() == "required" && pd.descriptor.Syntax().String() == "proto2" {
 		pd.write("required ")
@@ -369,22 +657,33 @@ func (pd *ProtoDefinition) writeEnumWithPath(enum protoreflect.EnumDescriptor, b
 	pd.write(string(enum.Name()))
 	pd.write(" {\n")
 	pd.indent()
+	options := append(pd.optionEntries(enum.Options()), pd.unknownEntries(enumPath...)...)
+	pd.warnEntries(string(enum.FullName()), options)
+	pd.writeOptionStatements(options, append(append([]int32{}, enumPath...), 3)) // 3 = options field in EnumDescriptorProto
+	declarations := pd.enumReservedDeclarations(enum, enumPath)
 	for i := 0; i < enum.Values().Len(); i++ {
 		value := enum.Values().Get(i)
 		valuePath := append(append([]int32{}, enumPath...), 2, int32(i)) // 2 = value field in EnumDescriptorProto
 
-		pd.writeLeadingComments(valuePath...)
-		pd.writeIndented(string(value.Name()))
-		pd.write(" = ")
-		pd.write(fmt.Sprintf("%d", value.Number()))
-		pd.write(";")
-		pd.writeTrailingComment(valuePath...)
-		pd.write("\n")
+		declarations = append(declarations, declaration{span: pd.spanAt(valuePath...), kind: valueDeclaration,
+			name: string(value.Name()), number: int32(value.Number()), write: func() {
+				pd.writeLeadingComments(valuePath...)
+				options := append(pd.optionEntries(value.Options()), pd.unknownEntries(valuePath...)...)
+				pd.warnEntries(string(value.FullName()), options)
+				pd.writeIndented(string(value.Name()))
+				pd.write(" = ")
+				pd.write(fmt.Sprintf("%d", value.Number()))
+				pd.writeOptionList(options)
+				pd.write(";")
+				pd.writeTrailingComment(valuePath...)
+				pd.write("\n")
+			}})
 	}
+	pd.writeDeclarations(declarations)
 	pd.dedent()
 	pd.writeIndented("}")
 	pd.writeTrailingComment(enumPath...)
-	pd.write("\n\n")
+	pd.endBlock(isNested)
 }
 
 func (pd *ProtoDefinition) writeEnum(enum protoreflect.EnumDescriptor) {
@@ -419,43 +718,56 @@ func (pd *ProtoDefinition) writeMessageWithPath(message protoreflect.MessageDesc
 	pd.write(string(message.Name()))
 	pd.write(" {\n")
 	pd.indent()
+	pd.writeMessageBody(message, msgPath)
+	pd.dedent()
+	pd.writeIndented("}")
+	pd.writeTrailingComment(msgPath...)
+	pd.endBlock(isNested)
+}
 
-	for i := 0; i < message.ReservedNames().Len(); i++ {
-		name := message.ReservedNames().Get(i)
-		pd.writeIndented("reserved \"")
-		pd.write(string(name))
-		pd.write("\";\n")
+// writeMessageBody writes the declarations inside a message or group
+func (pd *ProtoDefinition) writeMessageBody(message protoreflect.MessageDescriptor, msgPath []int32) {
+	options := append(pd.optionEntries(pd.messageOptions(message, msgPath)), pd.unknownEntries(msgPath...)...)
+	pd.warnEntries(string(message.FullName()), options)
+	pd.warnRanges(message.FullName(), "reserved", message.ReservedRanges())
+	pd.warnRanges(message.FullName(), "extension", message.ExtensionRanges())
+	pd.writeOptionStatements(options, append(append([]int32{}, msgPath...), 7)) // 7 = options field in DescriptorProto
+
+	names := make([]string, message.ReservedNames().Len())
+	for i := range names {
+		names[i] = quote([]byte(message.ReservedNames().Get(i)), true)
 	}
+	// 10 = reserved_name field in DescriptorProto
+	declarations := pd.reservedDeclarations(reservedDeclaration, "reserved", names, append(append([]int32{}, msgPath...), 10), nil)
 
-	for i := 0; i < message.ReservedRanges().Len(); i++ {
-		pd.writeIndented("reserved ")
-		reservedRange := message.ReservedRanges().Get(i)
-		if reservedRange[0] > reservedRange[1] {
-			reservedRange[1], reservedRange[0] = reservedRange[0], reservedRange[1]
-		}
-		reservedRange[1] -= 1
-		if reservedRange[0] == reservedRange[1] {
-			pd.write(fmt.Sprintf("%d", reservedRange[0]))
-		} else {
-			pd.write(fmt.Sprintf("%d", reservedRange[0]))
-			pd.write(" to ")
-			if reservedRange[1] == protowire.MaxValidNumber {
-				pd.write("max")
-			} else {
-				pd.write(fmt.Sprintf("%d", reservedRange[1]))
-			}
-		}
-		pd.write(";\n")
+	ranges := make([]string, message.ReservedRanges().Len())
+	for i := range ranges {
+		ranges[i] = formatFieldRange(message.ReservedRanges().Get(i))
 	}
+	// 9 = reserved_range field in DescriptorProto
+	declarations = append(declarations, pd.reservedDeclarations(reservedDeclaration, "reserved", ranges, append(append([]int32{}, msgPath...), 9), nil)...)
 
-	// Write nested messages
+	// Nested messages, except the MapEntry messages behind map fields and
+	// the messages of groups, which are written inline
 	for i := 0; i < message.Messages().Len(); i++ {
-		pd.writeMessageWithPath(message.Messages().Get(i), msgPath, i, true)
+		nested, i := message.Messages().Get(i), i
+		if nested.IsMapEntry() || isGroupMessage(nested) {
+			continue
+		}
+		// 3 = nested_type field in DescriptorProto
+		declarations = append(declarations, declaration{span: pd.spanAt(append(append([]int32{}, msgPath...), 3, int32(i))...),
+			kind: messageDeclaration, name: string(nested.Name()), write: func() {
+				pd.writeMessageWithPath(nested, msgPath, i, true)
+			}})
 	}
 
-	// Write nested enums
 	for i := 0; i < message.Enums().Len(); i++ {
-		pd.writeEnumWithPath(message.Enums().Get(i), msgPath, i, true)
+		enum, i := message.Enums().Get(i), i
+		// 4 = enum_type field in DescriptorProto
+		declarations = append(declarations, declaration{span: pd.spanAt(append(append([]int32{}, msgPath...), 4, int32(i))...),
+			kind: enumDeclaration, name: string(enum.Name()), write: func() {
+				pd.writeEnumWithPath(enum, msgPath, i, true)
+			}})
 	}
 
 	// Build field index map for oneof fields
@@ -467,23 +779,32 @@ func (pd *ProtoDefinition) writeMessageWithPath(message protoreflect.MessageDesc
 		fieldIndexMap[string(field.Name())] = i
 	}
 
-	// Write non-oneof fields
+	// Fields in field index order, with each oneof (which includes its
+	// fields) in place of its first field
+	writtenOneofs := make(map[int]bool)
 	for i := 0; i < message.Fields().Len(); i++ {
-		field := message.Fields().Get(i)
-		if field.ContainingOneof() == nil {
-			pd.writeFieldWithPath(field, msgPath, i)
+		field, i := message.Fields().Get(i), i
+		oneof := field.ContainingOneof()
+		if oneof == nil || oneof.IsSynthetic() {
+			declarations = append(declarations, declaration{span: pd.spanAt(append(append([]int32{}, msgPath...), 2, int32(i))...),
+				kind: fieldDeclaration, name: string(field.Name()), number: int32(field.Number()), write: func() {
+					pd.writeFieldWithPath(field, msgPath, i)
+				}})
+		} else if !writtenOneofs[oneof.Index()] {
+			writtenOneofs[oneof.Index()] = true
+			// 8 = oneof_decl field in DescriptorProto
+			declarations = append(declarations, declaration{span: pd.spanAt(append(append([]int32{}, msgPath...), 8, int32(oneof.Index()))...),
+				kind: fieldDeclaration, name: string(oneof.Name()), number: int32(field.Number()), write: func() {
+					pd.writeOneofWithPath(oneof, msgPath, oneof.Index(), fieldIndexMap)
+				}})
 		}
 	}
 
-	// Write oneofs (which include their fields)
-	for i := 0; i < message.Oneofs().Len(); i++ {
-		pd.writeOneofWithPath(message.Oneofs().Get(i), msgPath, i, fieldIndexMap)
-	}
+	declarations = append(declarations, pd.extensionRangeDeclarations(message, msgPath)...)
 
-	pd.dedent()
-	pd.writeIndented("}")
-	pd.writeTrailingComment(msgPath...)
-	pd.write("\n\n")
+	// 6 = extension field in DescriptorProto
+	declarations = append(declarations, pd.extendDeclarations(message.Extensions(), append(append([]int32{}, msgPath...), 6), true)...)
+	pd.writeDeclarations(declarations)
 }
 
 func (pd *ProtoDefinition) writeMessage(message protoreflect.MessageDescriptor) {
@@ -522,6 +843,9 @@ func (pd *ProtoDefinition) writeMessage(message protoreflect.MessageDescriptor)
 	}
 
 	for i := 0; i < message.Messages().Len(); i++ {
+		if message.Messages().Get(i).IsMapEntry() || isGroupMessage(message.Messages().Get(i)) {
+			continue
+		}
 		pd.writeMessage(message.Messages().Get(i))
 	}
 
@@ -543,146 +867,414 @@ func (pd *ProtoDefinition) writeMessage(message protoreflect.MessageDescriptor)
 	pd.writeIndented("}\n\n")
 }
 
-func (pd *ProtoDefinition) writeImport(fileImport protoreflect.FileImport) {
+// formatFieldRange formats a range of field numbers, whose end is exclusive
+func formatFieldRange(fieldRange [2]protoreflect.FieldNumber) string {
+	start, end := fieldRange[0], fieldRange[1]-1
+	if end <= start {
+		return strconv.Itoa(int(start))
+	}
+	if end == protowire.MaxValidNumber {
+		return strconv.Itoa(int(start)) + " to max"
+	}
+	return strconv.Itoa(int(start)) + " to " + strconv.Itoa(int(end))
+}
+
+// extensionRangeDeclarations returns the extensions statements of message,
+// along with their options, which are shared by the ranges of a statement
+func (pd *ProtoDefinition) extensionRangeDeclarations(message protoreflect.MessageDescriptor, msgPath []int32) []declaration {
+	ranges := make([]string, message.ExtensionRanges().Len())
+	for i := range ranges {
+		ranges[i] = formatFieldRange(message.ExtensionRanges().Get(i))
+	}
+	// 5 = extension_range field in DescriptorProto
+	return pd.reservedDeclarations(extensionRangeDeclaration, "extensions", ranges, append(append([]int32{}, msgPath...), 5), func(i int) []optionEntry {
+		rangePath := append(append([]int32{}, msgPath...), 5, int32(i))
+		options := append(pd.optionEntries(message.ExtensionRangeOptions(i)), pd.unknownEntries(rangePath...)...)
+		pd.warnEntries(string(message.FullName()), options)
+		return options
+	})
+}
+
+// enumReservedDeclarations returns the reserved statements of enum
+func (pd *ProtoDefinition) enumReservedDeclarations(enum protoreflect.EnumDescriptor, enumPath []int32) []declaration {
+	names := make([]string, enum.ReservedNames().Len())
+	for i := range names {
+		names[i] = quote([]byte(enum.ReservedNames().Get(i)), true)
+	}
+	// 5 = reserved_name field in EnumDescriptorProto
+	declarations := pd.reservedDeclarations(reservedDeclaration, "reserved", names, append(append([]int32{}, enumPath...), 5), nil)
+
+	ranges := make([]string, enum.ReservedRanges().Len())
+	for i := range ranges {
+		// Enum ranges are inclusive, unlike message ranges
+		reservedRange := enum.ReservedRanges().Get(i)
+		ranges[i] = strconv.Itoa(int(reservedRange[0]))
+		if reservedRange[1] != reservedRange[0] {
+			ranges[i] += " to "
+			if reservedRange[1] == math.MaxInt32 {
+				ranges[i] += "max"
+			} else {
+				ranges[i] += strconv.Itoa(int(reservedRange[1]))
+			}
+		}
+	}
+	// 4 = reserved_range field in EnumDescriptorProto
+	return append(declarations, pd.reservedDeclarations(reservedDeclaration, "reserved", ranges, append(append([]int32{}, enumPath...), 4), nil)...)
+}
+
+// reservedDeclarations returns keyword statements, like reserved or
+// extensions, for the elements at path. protoc records a location at path for
+// every statement, and elements within its span were declared together, so
+// they are written together again. options returns the options of the
+// statement given its first element, if any, and is called before the
+// statement is written so that it can warn about them.
+func (pd *ProtoDefinition) reservedDeclarations(kind declarationKind, keyword string, elements []string, path []int32, options func(first int) []optionEntry) []declaration {
+	var declarations []declaration
+	for i := 0; i < len(elements); {
+		info := pd.statementComments(path, append(append([]int32{}, path...), int32(i)))
+		first := i
+		for i++; i < len(elements) && info != nil &&
+			pd.statementComments(path, append(append([]int32{}, path...), int32(i))) == info; i++ {
+		}
+		group := elements[first:i]
+
+		var span []int32
+		if info != nil {
+			span = info.Span
+		} else {
+			span = pd.spanAt(append(append([]int32{}, path...), int32(first))...)
+		}
+		// Ranges are ordered by their start
+		number, _ := strconv.Atoi(strings.Fields(group[0])[0])
+		declarations = append(declarations, declaration{span: span, kind: kind, number: int32(number), write: func() {
+			pd.writeLeadingCommentInfo(info)
+			var entries []optionEntry
+			if options != nil {
+				entries = options(first)
+			}
+			pd.writeIndented(keyword)
+			pd.write(" ")
+			pd.write(strings.Join(group, ", "))
+			pd.writeOptionList(entries)
+			pd.write(";")
+			pd.writeTrailingCommentInfo(info)
+			pd.write("\n")
+		}})
+	}
+	return declarations
+}
+
+// statementComments returns the location at statementPath whose span
+// contains the element at elementPath, or nil
+func (pd *ProtoDefinition) statementComments(statementPath []int32, elementPath []int32) *CommentInfo {
+	element := pd.getComments(elementPath...)
+	if element == nil || len(element.Span) < 3 {
+		return nil
+	}
+	for _, info := range pd.blockComments[pathKey(statementPath)] {
+		if len(info.Span) >= 3 && spanContains(info.Span, element.Span) {
+			return info
+		}
+	}
+	return nil
+}
+
+// spanContains reports whether the SourceCodeInfo span outer contains inner
+func spanContains(outer []int32, inner []int32) bool {
+	before := func(line1, column1, line2, column2 int32) bool {
+		return line1 < line2 || (line1 == line2 && column1 <= column2)
+	}
+	return before(outer[0], outer[1], inner[0], inner[1]) &&
+		before(spanEndLine(inner), inner[len(inner)-1], spanEndLine(outer), outer[len(outer)-1])
+}
+
+// spanEndLine returns the last line of a SourceCodeInfo span
+func spanEndLine(span []int32) int32 {
+	if len(span) == 4 {
+		return span[2]
+	}
+	return span[0]
+}
+
+// extendDeclarations returns extend blocks for extensions, one per run of
+// consecutive extensions of the same message. protoc records a location at
+// extendPath for every extend block, and extensions within its span were
+// declared together.
+func (pd *ProtoDefinition) extendDeclarations(extensions protoreflect.ExtensionDescriptors, extendPath []int32, isNested bool) []declaration {
+	var declarations []declaration
+	for i := 0; i < extensions.Len(); {
+		extendee := extensions.Get(i).ContainingMessage().FullName()
+		info := pd.statementComments(extendPath, append(append([]int32{}, extendPath...), int32(i)))
+		first := i
+		for i++; i < extensions.Len() && extensions.Get(i).ContainingMessage().FullName() == extendee &&
+			pd.statementComments(extendPath, append(append([]int32{}, extendPath...), int32(i))) == info; i++ {
+		}
+		last := i
+
+		var span []int32
+		if info != nil {
+			span = info.Span
+		}
+		declarations = append(declarations, declaration{span: span, kind: extendDeclaration, name: string(extendee),
+			number: int32(extensions.Get(first).Number()), write: func() {
+				pd.writeLeadingCommentInfo(info)
+				pd.warnType(extensions.Get(first).FullName(), extensions.Get(first).ContainingMessage())
+				pd.writeIndented("extend ")
+				pd.write(pd.typeName(extendee, extensions.Get(first).FullName()))
+				pd.write(" {\n")
+				pd.indent()
+				for j := first; j < last; j++ {
+					pd.writeFieldAtPath(extensions.Get(j), append(append([]int32{}, extendPath...), int32(j)))
+				}
+				pd.dedent()
+				pd.writeIndented("}")
+				pd.writeTrailingCommentInfo(info)
+				if isNested {
+					pd.write("\n")
+				} else {
+					pd.write("\n\n")
+				}
+			}})
+	}
+	return declarations
+}
+
+// declarationKind groups declarations when they are sorted by name or number
+type declarationKind int
+
+const (
+	reservedDeclaration declarationKind = iota
+	serviceDeclaration
+	methodDeclaration
+	messageDeclaration
+	enumDeclaration
+	valueDeclaration
+	fieldDeclaration
+	extensionRangeDeclaration
+	extendDeclaration
+)
+
+// declaration is a statement in the body of a file, message, enum or service
+type declaration struct {
+	// span is the statement's SourceCodeInfo span, if known
+	span []int32
+	kind declarationKind
+	// name and number order declarations of the same kind for SortByName
+	// and SortByNumber, a oneof is numbered by its first field
+	name   string
+	number int32
+	write  func()
+}
+
+// writeDeclarations writes declarations in source order when their spans are
+// known. Declarations without a span stay right after the one they follow.
+// SortByName and SortByNumber then group declarations by kind and order them
+// within each kind.
+func (pd *ProtoDefinition) writeDeclarations(declarations []declaration) {
+	var last []int32
+	for i := range declarations {
+		if len(declarations[i].span) < 3 {
+			declarations[i].span = last
+		} else {
+			last = declarations[i].span
+		}
+	}
+	sort.SliceStable(declarations, func(i, j int) bool {
+		a, b := declarations[i].span, declarations[j].span
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		return a[0] < b[0] || (a[0] == b[0] && a[1] < b[1])
+	})
+	if pd.options.Sort == SortByName || pd.options.Sort == SortByNumber {
+		sort.SliceStable(declarations, func(i, j int) bool {
+			a, b := declarations[i], declarations[j]
+			if a.kind != b.kind {
+				return a.kind < b.kind
+			}
+			if pd.options.Sort == SortByName {
+				return a.name < b.name
+			}
+			return a.number < b.number
+		})
+	}
+	for _, declaration := range declarations {
+		declaration.write()
+	}
+}
+
+// spanAt returns the SourceCodeInfo span of path, or nil
+func (pd *ProtoDefinition) spanAt(path ...int32) []int32 {
+	if info := pd.getComments(path...); info != nil {
+		return info.Span
+	}
+	return nil
+}
+
+func (pd *ProtoDefinition) writeImport(fileImport protoreflect.FileImport, importIdx int) {
+	importPath := []int32{3, int32(importIdx)} // 3 = dependency field in FileDescriptorProto
+
+	pd.writeLeadingComments(importPath...)
 	pd.write("import ")
 	if fileImport.IsPublic {
 		pd.write("public ")
 	}
 	pd.write("\"")
 	pd.write(fileImport.Path())
-	pd.write("\";\n")
+	pd.write("\";")
+	pd.writeTrailingComment(importPath...)
+	pd.write("\n")
 }
 
-func (pd *ProtoDefinition) writeStringFileOptions(name string, value string) {
-	pd.write("option ")
-	pd.write(name)
-	pd.write(" = \"")
-	pd.write(strings.ReplaceAll(value, "\\", "\\\\"))
-	pd.write("\";\n")
-}
+// writeFileOptions writes every populated field of FileOptions in field number
+// order
+func (pd *ProtoDefinition) writeFileOptions() {
+	options := pd.optionEntries(pd.pb.GetOptions())
+	pd.warnEntries(pd.descriptor.Path(), options)
+	pd.writeOptionStatements(options, []int32{8}) // 8 = options field in FileDescriptorProto
 
-func (pd *ProtoDefinition) writeBoolFileOptions(name string, value bool) {
-	pd.write("option ")
-	pd.write(name)
-	pd.write(" = ")
-	pd.write(strconv.FormatBool(value))
-	pd.write(";\n")
+	if len(options) > 0 {
+		pd.write("\n")
+	}
 }
 
-func (pd *ProtoDefinition) writeFileOptions() {
-	optionDefinitions := []struct {
-		OptionName string
-		FieldName  string
-	}{
-		{"java_package", "JavaPackage"},
-		{"java_outer_classname", "JavaOuterClassname"},
-		{"java_multiple_files", "JavaMultipleFiles"},
-		{"java_string_check_utf8", "JavaStringCheckUtf8"},
-		// TODO OptimizeMode: https://github.com/protocolbuffers/protobuf/blob/main/src/google/protobuf/descriptor.proto#L384
-		{"go_package", "GoPackage"},
-		// TODO generic services: https://github.com/protocolbuffers/protobuf/blob/main/src/google/protobuf/descriptor.proto#L403
-		// TODO deprecated: https://github.com/protocolbuffers/protobuf/blob/main/src/google/protobuf/descriptor.proto#L412
-		{"cc_enable_arenas", "CcEnableArenas"},
-		{"objc_class_prefix", "ObjcClassPrefix"},
-		{"csharp_namespace", "CsharpNamespace"},
-		{"swift_prefix", "SwiftPrefix"},
-		{"php_class_prefix", "PhpClassPrefix"},
-		{"php_namespace", "PhpNamespace"},
-		{"php_metadata_namespace", "PhpMetadataNamespace"},
-		{"ruby_package", "RubyPackage"},
-	}
-
-	optionsPtr := reflect.ValueOf(pd.pb.GetOptions())
-	if optionsPtr.IsNil() {
-		return
-	}
-	options := optionsPtr.Elem()
-	printedOption := false
-	for _, option := range optionDefinitions {
-		elemPtr := options.FieldByName(option.FieldName)
-		if !elemPtr.IsNil() {
-			elem := elemPtr.Elem()
-			kind := elem.Kind()
-			if kind == reflect.String {
-				pd.writeStringFileOptions(option.OptionName, elem.String())
-			} else if kind == reflect.Bool {
-				pd.writeBoolFileOptions(option.OptionName, elem.Bool())
-			}
-			printedOption = true
-		}
-	}
+// writeFileUnknown writes the unknown fields of the file as comments, after
+// its imports and options
+func (pd *ProtoDefinition) writeFileUnknown() {
+	unknown := pd.unknownEntries()
+	pd.warnEntries(pd.descriptor.Path(), unknown)
+	pd.writeOptionStatements(unknown, nil)
 
-	if printedOption {
+	if len(unknown) > 0 {
 		pd.write("\n")
 	}
 }
 
 func (pd *ProtoDefinition) writeFileDescriptor() {
-	// Write file-level leading comment (attached to syntax)
-	pd.writeLeadingComments(12) // 12 = syntax field in FileDescriptorProto
+	// Write file-level leading comment (attached to syntax, or edition)
+	syntaxPath := []int32{12} // 12 = syntax field in FileDescriptorProto
+	if pd.descriptor.Syntax() == protoreflect.Editions {
+		syntaxPath = []int32{14} // 14 = edition field in FileDescriptorProto
+	}
+	pd.writeLeadingComments(syntaxPath...)
 
-	pd.write("syntax = \"")
-	pd.write(pd.descriptor.Syntax().String())
-	pd.write("\";\n\n")
+	if pd.descriptor.Syntax() == protoreflect.Editions {
+		pd.write("edition = \"")
+		pd.write(strings.TrimPrefix(pd.pb.GetEdition().String(), "EDITION_"))
+		pd.write("\";")
+	} else {
+		pd.write("syntax = \"")
+		pd.write(pd.descriptor.Syntax().String())
+		pd.write("\";")
+	}
+	pd.writeTrailingComment(syntaxPath...)
+	pd.write("\n\n")
 
 	packageName := pd.descriptor.FullName()
 	if packageName != "" {
+		pd.writeLeadingComments(2) // 2 = package field in FileDescriptorProto
 		pd.write("package ")
 		pd.write(string(packageName))
-		pd.write(";\n\n")
+		pd.write(";")
+		pd.writeTrailingComment(2)
+		pd.write("\n\n")
 	}
 
 	pd.writeFileOptions()
 
 	for i := 0; i < pd.descriptor.Imports().Len(); i++ {
-		pd.writeImport(pd.descriptor.Imports().Get(i))
+		pd.writeImport(pd.descriptor.Imports().Get(i), i)
 	}
 
 	if pd.descriptor.Imports().Len() > 0 {
 		pd.write("\n")
 	}
 
+	pd.writeFileUnknown()
+
+	var declarations []declaration
 	for i := 0; i < pd.descriptor.Services().Len(); i++ {
-		pd.writeServiceWithPath(pd.descriptor.Services().Get(i), i)
+		service, i := pd.descriptor.Services().Get(i), i
+		declarations = append(declarations, declaration{span: pd.spanAt(6, int32(i)), kind: serviceDeclaration, name: string(service.Name()), write: func() {
+			pd.writeServiceWithPath(service, i)
+		}})
 	}
 
 	for i := 0; i < pd.descriptor.Messages().Len(); i++ {
-		pd.writeMessageWithPath(pd.descriptor.Messages().Get(i), nil, i, false)
+		message, i := pd.descriptor.Messages().Get(i), i
+		if isGroupMessage(message) {
+			continue
+		}
+		declarations = append(declarations, declaration{span: pd.spanAt(4, int32(i)), kind: messageDeclaration, name: string(message.Name()), write: func() {
+			pd.writeMessageWithPath(message, nil, i, false)
+		}})
 	}
 
 	for i := 0; i < pd.descriptor.Enums().Len(); i++ {
-		pd.writeEnumWithPath(pd.descriptor.Enums().Get(i), nil, i, false)
+		enum, i := pd.descriptor.Enums().Get(i), i
+		declarations = append(declarations, declaration{span: pd.spanAt(5, int32(i)), kind: enumDeclaration, name: string(enum.Name()), write: func() {
+			pd.writeEnumWithPath(enum, nil, i, false)
+		}})
 	}
+
+	// 7 = extension field in FileDescriptorProto
+	declarations = append(declarations, pd.extendDeclarations(pd.descriptor.Extensions(), []int32{7}, false)...)
+	pd.writeDeclarations(declarations)
+}
+
+// render writes the file descriptor from scratch with options and returns
+// the output
+func (pd *ProtoDefinition) render(options RenderOptions) string {
+	pd.builder.Reset()
+	pd.indendation = 0
+	pd.options = options
+	pd.symbols = nil
+	pd.diagnostics = nil
+	pd.writeFileDescriptor()
+	return pd.builder.String()
 }
 
 func NewFromBytes(payload []byte) (*ProtoDefinition, error) {
+	pb, err := unmarshalFileDescriptorProto(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFromDescriptor(pb)
+}
+
+func unmarshalFileDescriptorProto(payload []byte) (*descriptorpb.FileDescriptorProto, error) {
 	var pb descriptorpb.FileDescriptorProto
 	err := proto.Unmarshal(payload, &pb)
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't unmarshal proto: %w", err)
 	}
-
-	return NewFromDescriptor(&pb)
+	return &pb, nil
 }
 
 func NewFromDescriptor(pb *descriptorpb.FileDescriptorProto) (*ProtoDefinition, error) {
-	fileOptions := protodesc.FileOptions{AllowUnresolvable: true}
-	descriptor, err := fileOptions.New(pb, &protoregistry.Files{})
+	descriptor, err := buildFile(pb, &protoregistry.Files{})
 
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't create FileDescriptor: %w", err)
 	}
 
+	return newDefinition(pb, descriptor, nil), nil
+}
+
+// newDefinition renders pb, built as descriptor, with custom options resolved
+// by extensions if set
+func newDefinition(pb *descriptorpb.FileDescriptorProto, descriptor protoreflect.FileDescriptor, extensions protoregistry.ExtensionTypeResolver) *ProtoDefinition {
 	pd := ProtoDefinition{
 		pb:         pb,
 		descriptor: descriptor,
+		extensions: extensions,
 	}
 
 	// Build comment map from SourceCodeInfo
 	pd.buildCommentMap()
 
-	pd.writeFileDescriptor()
-
-	return &pd, nil
+	pd.text = pd.render(RenderOptions{})
 
+	return &pd
 }
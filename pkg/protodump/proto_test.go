@@ -9,12 +9,23 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
 	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 const FIXTURES = "fixtures"
 
-func convertProtoToFileDescriptor(filePath string) (*descriptorpb.FileDescriptorProto, error) {
+func convertProtoToFileDescriptor(filePath string, args ...string) (*descriptorpb.FileDescriptorProto, error) {
+	files, err := convertProtoToFileDescriptors(filePath, args...)
+	if err != nil {
+		return nil, err
+	}
+	return files[len(files)-1], nil
+}
+
+// convertProtoToFileDescriptors returns every file protoc writes, which are
+// the file's imports followed by the file itself with --include_imports
+func convertProtoToFileDescriptors(filePath string, args ...string) ([]*descriptorpb.FileDescriptorProto, error) {
 	dir, err := os.MkdirTemp("", "")
 	if err != nil {
 		return nil, err
@@ -22,7 +33,8 @@ func convertProtoToFileDescriptor(filePath string) (*descriptorpb.FileDescriptor
 	defer os.RemoveAll(dir)
 
 	filename := "proto.bin"
-	cmd := exec.Command("protoc", fmt.Sprintf("--go_out=%s", dir), fmt.Sprintf("--descriptor_set_out=%s", path.Join(dir, filename)), filePath)
+	args = append(args, fmt.Sprintf("--go_out=%s", dir), fmt.Sprintf("--descriptor_set_out=%s", path.Join(dir, filename)), filePath)
+	cmd := exec.Command("protoc", args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		fmt.Print(string(output))
@@ -39,7 +51,7 @@ func convertProtoToFileDescriptor(filePath string) (*descriptorpb.FileDescriptor
 	if err != nil {
 		return nil, err
 	}
-	return descriptor.GetFile()[0], nil
+	return descriptor.GetFile(), nil
 }
 
 func TestDefinitions(t *testing.T) {
@@ -49,16 +61,65 @@ func TestDefinitions(t *testing.T) {
 	for _, file := range files {
 		t.Run(file.Name(), func(t *testing.T) {
 			filePath := path.Join(FIXTURES, file.Name())
-			descriptor, err := convertProtoToFileDescriptor(filePath)
+			descriptor, err := convertProtoToFileDescriptor(filePath, "--include_source_info")
 			assert.NoError(t, err)
 
 			expected, err := os.ReadFile(filePath)
 			assert.NoError(t, err)
 
+			// Declarations follow the source order, which the fixtures share
+			// with the descriptor's
 			actual, err := NewFromDescriptor(descriptor)
 			assert.NoError(t, err)
+			actual.SetExtensionResolver(NewRegistry([]*descriptorpb.FileDescriptorProto{descriptor}))
 
 			assert.Equal(t, string(expected), actual.String())
+
+			// Without SourceCodeInfo declarations keep the descriptor's order,
+			// which the fixtures are written in
+			withoutSource := proto.Clone(descriptor).(*descriptorpb.FileDescriptorProto)
+			withoutSource.SourceCodeInfo = nil
+			actual, err = NewFromDescriptor(withoutSource)
+			assert.NoError(t, err)
+			actual.SetExtensionResolver(NewRegistry([]*descriptorpb.FileDescriptorProto{withoutSource}))
+			assert.Equal(t, string(expected), actual.String())
 		})
 	}
 }
+
+func TestEditionsLegacyLabels(t *testing.T) {
+	filePath := path.Join(FIXTURES, "editions.edition2023")
+	descriptor, err := convertProtoToFileDescriptor(filePath)
+	assert.NoError(t, err)
+
+	expected, err := os.ReadFile(filePath)
+	assert.NoError(t, err)
+
+	// Older protoc versions write required and delimited fields of Editions
+	// files as proto2 style labels and types
+	fields := descriptor.GetMessageType()[0].GetField()
+	fields[0].Label = descriptorpb.FieldDescriptorProto_LABEL_REQUIRED.Enum()
+	fields[0].Options = nil
+	fields[2].Type = descriptorpb.FieldDescriptorProto_TYPE_GROUP.Enum()
+	fields[2].Options = nil
+
+	actual, err := NewFromDescriptor(descriptor)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), actual.String())
+}
+
+func TestUnresolvedOptions(t *testing.T) {
+	descriptor, err := convertProtoToFileDescriptor(path.Join(FIXTURES, "custom_options.proto2"))
+	assert.NoError(t, err)
+
+	actual, err := NewFromDescriptor(descriptor)
+	assert.NoError(t, err)
+	actual.SetExtensionResolver(&protoregistry.Types{})
+
+	output := actual.String()
+	assert.Contains(t, output, "option go_package = \"./;helloworld\";\n// unresolved option (50000) = \"demo\";\n")
+	// protoc doesn't promise the field order of aggregate values
+	assert.Regexp(t, `\n  // unresolved option \(50001\) = ".*acct.*";\n`, output)
+	assert.Contains(t, output, "optional string name = 1 /* unresolved option (50002) = \"\\n\\006[a-z]+\" */ /* unresolved option (50003) = 1 */;")
+	assert.Contains(t, output, "LEVEL_LOW = 0 /* unresolved option (50004) = 0x3ff8000000000000 */;")
+}
@@ -0,0 +1,61 @@
+package protodump
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// modulePath is the path of the protodump module, looked up in build info
+const modulePath = "github.com/zjx20/protodump"
+
+// Version returns the version of protodump, taken from the build info of the
+// binary it is linked into, or "(devel)" when unknown
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+	if info.Main.Path == modulePath && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath && dep.Version != "" {
+			return dep.Version
+		}
+	}
+	return "(devel)"
+}
+
+// SHA256 returns the hex encoded SHA-256 of the serialized descriptor
+func (r Result) SHA256() string {
+	sum := sha256.Sum256(r.Data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Provenance returns header lines recording where the descriptor was found in
+// the input file and how it was extracted, see ProtoDefinition.SetHeader
+func (r Result) Provenance(input string) []string {
+	// Descriptors of UPX packed binaries are located in the unpacked image
+	// rather than the file
+	where := ""
+	if strings.HasPrefix(r.Method, MethodUPX+"+") {
+		where = " in the unpacked UPX image"
+	}
+	lines := []string{"Source: " + input}
+	if r.Location != "" {
+		lines = append(lines, "Location"+where+": "+r.Location)
+	}
+	lines = append(lines, fmt.Sprintf("Offset%s: %d (0x%x), length: %d bytes", where, r.Offset, r.Offset, r.Length))
+	if r.Set != nil {
+		lines = append(lines, fmt.Sprintf("Descriptor set%s: offset %d (0x%x), length: %d bytes, %d files",
+			where, r.Set.Offset, r.Set.Offset, r.Set.Length, r.Set.Files))
+	}
+	return append(lines,
+		"SHA-256: "+r.SHA256(),
+		"Extraction method: "+r.Method,
+		"protodump version: "+Version(),
+	)
+}
@@ -0,0 +1,76 @@
+package protodump
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestProvenance(t *testing.T) {
+	descriptor := descriptorBytes(t)
+	sum := sha256.Sum256(descriptor)
+	hash := hex.EncodeToString(sum[:])
+
+	padding := make([]byte, 64)
+	results := ScanResults(bytes.Join([][]byte{padding, descriptor}, nil))
+	if !assert.Len(t, results, 1) {
+		return
+	}
+	result := results[0]
+	assert.Equal(t, "", result.Location)
+	assert.Equal(t, hash, result.SHA256())
+	assert.Equal(t, []string{
+		"Source: bin/server",
+		fmt.Sprintf("Offset: 64 (0x40), length: %d bytes", len(descriptor)),
+		"SHA-256: " + hash,
+		"Extraction method: raw",
+		"protodump version: " + Version(),
+	}, result.Provenance("bin/server"))
+
+	result.Method = MethodUPX + "+" + MethodGzip
+	result.Location = "section .rodata"
+	assert.Equal(t, []string{
+		"Source: bin/server",
+		"Location in the unpacked UPX image: section .rodata",
+		fmt.Sprintf("Offset in the unpacked UPX image: 64 (0x40), length: %d bytes", len(descriptor)),
+		"SHA-256: " + hash,
+		"Extraction method: upx+gzip",
+		"protodump version: " + Version(),
+	}, result.Provenance("bin/server"))
+}
+
+func TestProvenanceDescriptorSet(t *testing.T) {
+	timestamp := protodesc.ToFileDescriptorProto(timestamppb.File_google_protobuf_timestamp_proto)
+	set, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(descriptorpb.File_google_protobuf_descriptor_proto),
+		timestamp,
+	}})
+	assert.NoError(t, err)
+	descriptor, err := proto.Marshal(timestamp)
+	assert.NoError(t, err)
+	sum := sha256.Sum256(descriptor)
+
+	padding := make([]byte, 64)
+	results := ScanResults(bytes.Join([][]byte{padding, set}, nil))
+	if !assert.Len(t, results, 2) {
+		return
+	}
+	// The timestamp descriptor ends the set
+	offset := len(padding) + len(set) - len(descriptor)
+	assert.Equal(t, []string{
+		"Source: bin/server",
+		fmt.Sprintf("Offset: %d (0x%x), length: %d bytes", offset, offset, len(descriptor)),
+		fmt.Sprintf("Descriptor set: offset 64 (0x40), length: %d bytes, 2 files", len(set)),
+		"SHA-256: " + hex.EncodeToString(sum[:]),
+		"Extraction method: descriptor-set",
+		"protodump version: " + Version(),
+	}, results[1].Provenance("bin/server"))
+}
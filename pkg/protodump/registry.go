@@ -0,0 +1,153 @@
+package protodump
+
+import (
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Registry holds the descriptors dumped from a binary, built against each
+// other so that types from one file resolve in the files importing it
+type Registry struct {
+	files *protoregistry.Files
+	types *protoregistry.Types
+	// protos holds the descriptor each registered file was built from
+	protos map[string]*descriptorpb.FileDescriptorProto
+	// unresolved holds the imports of each file that couldn't be found
+	unresolved map[string][]string
+	// canonical holds the well-known types files that were imported but not
+	// among the files, which the canonical version was registered for
+	canonical []string
+}
+
+// NewRegistry builds a Registry from files, in dependency order. Imports of
+// well-known types files that aren't among files resolve against the
+// canonical version, other imports that aren't are left unresolved rather
+// than failing the whole file.
+func NewRegistry(files []*descriptorpb.FileDescriptorProto) *Registry {
+	r := &Registry{
+		files:      &protoregistry.Files{},
+		types:      &protoregistry.Types{},
+		protos:     make(map[string]*descriptorpb.FileDescriptorProto),
+		unresolved: make(map[string][]string),
+	}
+
+	byName := make(map[string]*descriptorpb.FileDescriptorProto)
+	for _, file := range files {
+		if _, ok := byName[file.GetName()]; !ok {
+			byName[file.GetName()] = file
+		}
+	}
+
+	visited := make(map[string]bool)
+	var build func(file *descriptorpb.FileDescriptorProto)
+	build = func(file *descriptorpb.FileDescriptorProto) {
+		if visited[file.GetName()] {
+			return
+		}
+		visited[file.GetName()] = true
+		for _, dependency := range file.GetDependency() {
+			if imported, ok := byName[dependency]; ok {
+				build(imported)
+			} else if wellKnown, ok := WellKnownFile(dependency); ok && !visited[dependency] {
+				r.canonical = append(r.canonical, dependency)
+				build(protodesc.ToFileDescriptorProto(wellKnown))
+			}
+		}
+
+		descriptor, err := buildFile(file, r.files)
+		if err != nil {
+			debugPrintf("Couldn't build %s: %v\n", file.GetName(), err)
+			return
+		}
+		if err := r.files.RegisterFile(descriptor); err != nil {
+			debugPrintf("Couldn't register %s: %v\n", file.GetName(), err)
+			return
+		}
+		r.protos[file.GetName()] = file
+		r.registerExtensions(descriptor.Extensions())
+		r.registerMessages(descriptor.Messages())
+
+		for _, dependency := range file.GetDependency() {
+			if _, err := r.files.FindFileByPath(dependency); err != nil {
+				r.unresolved[file.GetName()] = append(r.unresolved[file.GetName()], dependency)
+			}
+		}
+	}
+	for _, file := range files {
+		build(file)
+	}
+	return r
+}
+
+// UnresolvedImports returns the imports that couldn't be found, keyed by the
+// name of the importing file. An import is unresolved when it isn't among
+// the files or it couldn't be built.
+func (r *Registry) UnresolvedImports() map[string][]string {
+	return r.unresolved
+}
+
+// CanonicalImports returns the imported well-known types files that weren't
+// among the files, which resolve against the canonical version instead
+func (r *Registry) CanonicalImports() []string {
+	return r.canonical
+}
+
+// FindFileByPath looks up a file by its path
+func (r *Registry) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	return r.files.FindFileByPath(path)
+}
+
+// fileDescriptor returns what file was built into, or nil when it wasn't
+// registered, e.g. because another file of the same name was
+func (r *Registry) fileDescriptor(file *descriptorpb.FileDescriptorProto) protoreflect.FileDescriptor {
+	if r.protos[file.GetName()] != file {
+		return nil
+	}
+	descriptor, err := r.files.FindFileByPath(file.GetName())
+	if err != nil {
+		return nil
+	}
+	return descriptor
+}
+
+func (r *Registry) registerMessages(messages protoreflect.MessageDescriptors) {
+	for i := 0; i < messages.Len(); i++ {
+		r.registerExtensions(messages.Get(i).Extensions())
+		r.registerMessages(messages.Get(i).Messages())
+	}
+}
+
+func (r *Registry) registerExtensions(extensions protoreflect.ExtensionDescriptors) {
+	for i := 0; i < extensions.Len(); i++ {
+		extension := extensions.Get(i)
+		// Message values can only be decoded when their type is known
+		if extension.Message() != nil && extension.Message().IsPlaceholder() {
+			debugPrintf("Skipping extension %s of unresolved type %s\n", extension.FullName(), extension.Message().FullName())
+			continue
+		}
+		if err := r.types.RegisterExtension(dynamicpb.NewExtensionType(extension)); err != nil {
+			debugPrintf("Couldn't register extension %s: %v\n", extension.FullName(), err)
+		}
+	}
+}
+
+// FindExtensionByName looks up an extension by its full name, falling back to
+// the extensions linked into protodump itself
+func (r *Registry) FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	if extension, err := r.types.FindExtensionByName(field); err == nil {
+		return extension, nil
+	}
+	return protoregistry.GlobalTypes.FindExtensionByName(field)
+}
+
+// FindExtensionByNumber looks up an extension of message by field number,
+// falling back to the extensions linked into protodump itself
+func (r *Registry) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	if extension, err := r.types.FindExtensionByNumber(message, field); err == nil {
+		return extension, nil
+	}
+	return protoregistry.GlobalTypes.FindExtensionByNumber(message, field)
+}
@@ -0,0 +1,118 @@
+package protodump
+
+import (
+	"io"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// TypeNames selects how type references are written
+type TypeNames int
+
+const (
+	// FullyQualifiedNames writes every type with its full name and a leading
+	// dot, e.g. `.hello.world.HelloRequest`
+	FullyQualifiedNames TypeNames = iota
+	// PackageRelativeNames drops the package of types declared in the file's
+	// own package, e.g. `HelloRequest`. Types of other packages stay fully
+	// qualified.
+	PackageRelativeNames
+	// MinimalNames writes the shortest name that protoc resolves to the type
+	// from where it is referenced, taking types and packages shadowing it
+	// into account, e.g. `Test` within `HelloRequest`
+	MinimalNames
+)
+
+// SortOrder selects the order of the declarations within a block
+type SortOrder int
+
+const (
+	// SortDeclaration keeps the order of the source file when SourceCodeInfo
+	// is present, and the order of the descriptor otherwise
+	SortDeclaration SortOrder = iota
+	// SortByName orders declarations of the same kind by name
+	SortByName
+	// SortByNumber orders fields, oneofs, enum values, extension ranges and
+	// extend blocks by number. Other declarations keep their order.
+	SortByNumber
+)
+
+// BlankLines selects where blank lines separate declarations
+type BlankLines int
+
+const (
+	// BlankLinesAfterBlocks follows every message, enum, service and
+	// top-level extend block with a blank line
+	BlankLinesAfterBlocks BlankLines = iota
+	// BlankLinesTopLevel only separates top-level declarations, nested
+	// messages and enums are followed directly by the next declaration
+	BlankLinesTopLevel
+)
+
+// RenderOptions configures how a definition is written. The zero value is
+// the default output of String.
+type RenderOptions struct {
+	// Indent is written once per nesting level, two spaces when empty
+	Indent string
+	// TypeNames selects how type references are written
+	TypeNames TypeNames
+	// Sort selects the order of declarations within a block
+	Sort SortOrder
+	// OmitComments leaves out the comments found in SourceCodeInfo
+	OmitComments bool
+	// BlankLines selects where blank lines separate declarations
+	BlankLines BlankLines
+	// InlineWarnings writes the diagnostics of the renderer as
+	// `// protodump: warning: ...` comments next to the declaration they
+	// concern, see Diagnostics
+	InlineWarnings bool
+}
+
+// Render writes the definition to w with options, along with its header, and
+// Diagnostics then returns those of this render. The options only apply to
+// this call, String always uses the default options.
+func (pd *ProtoDefinition) Render(w io.Writer, options RenderOptions) error {
+	_, err := io.WriteString(w, pd.withHeader(pd.render(options)))
+	return err
+}
+
+// indentString returns the indentation of a single nesting level
+func (pd *ProtoDefinition) indentString() string {
+	if pd.options.Indent == "" {
+		return "  "
+	}
+	return pd.options.Indent
+}
+
+// typeName returns how a reference to the type name is written by the
+// element from, e.g. a field or method. Relative names are only written when
+// they resolve to the same type.
+func (pd *ProtoDefinition) typeName(name protoreflect.FullName, from protoreflect.FullName) string {
+	if pd.options.TypeNames == MinimalNames {
+		return pd.minimalName(name, from)
+	}
+	if pd.options.TypeNames == PackageRelativeNames {
+		relative := ""
+		if packageName := string(pd.descriptor.Package()); packageName == "" {
+			relative = string(name)
+		} else if strings.HasPrefix(string(name), packageName+".") {
+			relative = strings.TrimPrefix(string(name), packageName+".")
+		}
+		// A nearer declaration may shadow the relative name
+		if relative != "" && pd.resolveName(relative, from) == name {
+			return relative
+		}
+	}
+	return "." + string(name)
+}
+
+// endBlock ends the line closing a message or enum, followed by a blank line
+// unless the blank line policy leaves it out for nested blocks
+func (pd *ProtoDefinition) endBlock(isNested bool) {
+	if isNested && pd.options.BlankLines == BlankLinesTopLevel {
+		pd.write("\n")
+	} else {
+		pd.write("\n\n")
+	}
+}
@@ -0,0 +1,74 @@
+package protodump
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// goldenCases render the files in testdata with options and compare the
+// output with golden, which is the file itself when empty
+var goldenCases = []struct {
+	proto   string
+	options RenderOptions
+	golden  string
+}{
+	{proto: "source_order.proto"},
+	{proto: "comments.proto"},
+	{proto: "render_options.proto"},
+	{proto: "render_options.proto", golden: "render_options.compact.golden", options: RenderOptions{
+		Indent:       "\t",
+		TypeNames:    PackageRelativeNames,
+		Sort:         SortByNumber,
+		OmitComments: true,
+		BlankLines:   BlankLinesTopLevel,
+	}},
+	{proto: "render_options.proto", golden: "render_options.by_name.golden", options: RenderOptions{Sort: SortByName, OmitComments: true}},
+	{proto: "minimal_names.proto", options: RenderOptions{TypeNames: MinimalNames}},
+	// Package relative names that are shadowed stay fully qualified
+	{proto: "minimal_names.proto", golden: "minimal_names.package_relative.golden", options: RenderOptions{TypeNames: PackageRelativeNames}},
+	// Without descriptor.proto neither the extendee nor the option resolve
+	{proto: "extension_ranges.proto", golden: "extension_ranges.warnings.golden", options: RenderOptions{InlineWarnings: true}},
+}
+
+func TestGolden(t *testing.T) {
+	for _, c := range goldenCases {
+		golden := c.golden
+		if golden == "" {
+			golden = c.proto
+		}
+		t.Run(golden, func(t *testing.T) {
+			descriptor, err := convertProtoToFileDescriptor(path.Join("testdata", c.proto), "--include_source_info")
+			assert.NoError(t, err)
+
+			expected, err := os.ReadFile(path.Join("testdata", golden))
+			assert.NoError(t, err)
+
+			actual, err := NewFromDescriptor(descriptor)
+			assert.NoError(t, err)
+			defaults := actual.String()
+			var output strings.Builder
+			assert.NoError(t, actual.Render(&output, c.options))
+			assert.Equal(t, string(expected), output.String())
+
+			// The options only apply to the call, String keeps the defaults
+			assert.Equal(t, defaults, actual.String())
+		})
+	}
+}
+
+func TestGoldenCoversTestdata(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.proto"))
+	assert.NoError(t, err)
+	covered := make(map[string]bool)
+	for _, c := range goldenCases {
+		covered[c.proto] = true
+	}
+	for _, file := range files {
+		assert.True(t, covered[filepath.Base(file)], "%s has no golden case", file)
+	}
+}
@@ -2,16 +2,41 @@ package protodump
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 const scan = ".proto"
 const magicByte = 0xa
 
+// gzipMagic is the gzip member header with the deflate compression method, as
+// used by golang/protobuf v1 to register compressed file descriptors
+var gzipMagic = []byte{0x1f, 0x8b, 0x08}
+
+const (
+	// maxGzipSize caps the decompressed size of a single gzip member
+	maxGzipSize = 64 << 20
+	// maxScanDepth caps how many compressed layers are unwrapped
+	maxScanDepth = 2
+)
+
+// Anchors looked for by the scanner, indexed by the ids used in anchorMatcher
+const (
+	anchorProto = iota
+	anchorGzip
+)
+
+var anchorMatcher = newMatcher([]byte(scan), gzipMagic)
+
 // Debug flag for verbose output
 var DebugScan = false
 
@@ -21,11 +46,44 @@ func debugPrintf(format string, args ...interface{}) {
 	}
 }
 
-func consumeBytes(data []byte, position int) (int, error) {
+func isPrintable(b byte) bool {
+	return b >= 0x20 && b <= 0x7e
+}
+
+// scanBuffer holds the state of a single forward pass over one buffer
+type scanBuffer struct {
+	data []byte
+	// failed records field boundaries from which consumeBytes is known to end
+	// in a parse error, so overlapping candidates don't walk them again
+	failed map[int]bool
+	// fields memoizes where fieldsEndAt parsed fields, see fieldNode
+	fields map[int]fieldNode
+	// gzip is reused across members to avoid allocating a decompressor for
+	// every false positive
+	gzip *gzip.Reader
+}
+
+func (sb *scanBuffer) consumeBytes(position int) (int, error) {
+	data := sb.data
 	start := position
 	consumedFieldOne := false
+	var visited []int
+	fail := func(err error) (int, error) {
+		for _, p := range visited {
+			sb.failed[p] = true
+		}
+		return position - start, err
+	}
+
 	for {
-		number, _, length := protowire.ConsumeField(data[position:])
+		if consumedFieldOne {
+			if sb.failed[position] {
+				return fail(fmt.Errorf("couldn't consume proto bytes: known bad data at %d", position))
+			}
+			visited = append(visited, position)
+		}
+
+		number, wireType, length := protowire.ConsumeField(data[position:])
 		if length < 0 {
 			err := protowire.ParseError(length)
 			// Treat "invalid field number" as end of data, not an error
@@ -33,7 +91,7 @@ func consumeBytes(data []byte, position int) (int, error) {
 				return position - start, nil
 			}
 			// Return other parse errors as actual errors
-			return position - start, fmt.Errorf("couldn't consume proto bytes: %w", err)
+			return fail(fmt.Errorf("couldn't consume proto bytes: %w", err))
 		}
 
 		// Prevent infinite loop - if we can't consume any bytes, we're done
@@ -41,6 +99,12 @@ func consumeBytes(data []byte, position int) (int, error) {
 			return position - start, nil
 		}
 
+		// Bytes following the descriptor often parse as fields too, but
+		// rarely as fields of FileDescriptorProto
+		if !isFileField(number, wireType) {
+			return position - start, nil
+		}
+
 		// Only consume Field 1 once (to handle the case where protobuf definitions are adjacent
 		// in program memory)
 		if number == 1 {
@@ -59,180 +123,559 @@ func consumeBytes(data []byte, position int) (int, error) {
 	}
 }
 
+// fileFields are the fields of FileDescriptorProto, which consumeBytes
+// expects a descriptor to be made of
+var fileFields = (&descriptorpb.FileDescriptorProto{}).ProtoReflect().Descriptor().Fields()
+
+// isFileField reports whether a field with number and wireType may be a field
+// of FileDescriptorProto
+func isFileField(number protowire.Number, wireType protowire.Type) bool {
+	field := fileFields.ByNumber(number)
+	if field == nil {
+		return false
+	}
+	switch field.Kind() {
+	case protoreflect.StringKind, protoreflect.BytesKind, protoreflect.MessageKind:
+		return wireType == protowire.BytesType
+	default:
+		// The scalars of FileDescriptorProto are all varints, and repeated
+		// ones may be packed
+		return wireType == protowire.VarintType || (field.IsList() && wireType == protowire.BytesType)
+	}
+}
+
+// Extraction methods reported in Result.Method
+const (
+	// MethodRaw is a file descriptor stored as is
+	MethodRaw = "raw"
+	// MethodGzip is a gzip compressed file descriptor
+	MethodGzip = "gzip"
+	// MethodDescriptorSet is a file descriptor unpacked from an embedded FileDescriptorSet
+	MethodDescriptorSet = "descriptor-set"
+	// MethodDescriptorFile is a file descriptor read from a standalone .pb, .desc or .protoset file
+	MethodDescriptorFile = "descriptor-file"
+	// MethodUPX prefixes the method of descriptors found in a UPX packed binary
+	MethodUPX = "upx"
+)
+
+// descriptorFileExts are the extensions of standalone descriptor files, which are
+// parsed as a whole instead of scanned
+var descriptorFileExts = []string{".pb", ".desc", ".protoset"}
+
+// DescriptorSet is a FileDescriptorSet found by the scanner. All the files
+// unpacked from it share the same DescriptorSet.
+type DescriptorSet struct {
+	// Offset and Length locate the set in the buffer it was found in
+	Offset int
+	Length int
+	// Files is the number of file descriptors in the set
+	Files int
+}
+
+// Result is a serialized file descriptor found by the scanner, along with
+// where and how it was found
+type Result struct {
+	// Data is the serialized FileDescriptorProto
+	Data []byte
+	// Offset and Length locate the descriptor in the scanned input. For
+	// compressed descriptors they locate the compressed data, and for UPX
+	// packed binaries they are relative to the unpacked image.
+	Offset int
+	Length int
+	// Method is how the descriptor was extracted, one of the Method* constants,
+	// joined with "+" when several layers were unwrapped
+	Method string
+	// Set is the FileDescriptorSet the descriptor belongs to, if any
+	Set *DescriptorSet
+	// GoPackage is the import path of the Go package that registered the
+	// descriptor, if it could be recovered from the binary's symbols
+	GoPackage string
+	// Location is the section and symbol of the executable holding the
+	// descriptor, e.g. `section .rodata, symbol main.rawDesc`, if known
+	Location string
+}
+
+func resultsData(results []Result) [][]byte {
+	data := make([][]byte, len(results))
+	for i, result := range results {
+		data[i] = result.Data
+	}
+	return data
+}
+
 func ScanFile(path string) ([][]byte, error) {
+	results, err := ScanFileResults(path)
+	if err != nil {
+		return nil, err
+	}
+	return resultsData(results), nil
+}
+
+// ScanFileResults scans the file at path for file descriptors. Standalone
+// descriptor files (.pb, .desc, .protoset) are parsed as a whole, and UPX
+// packed binaries are unpacked before scanning.
+func ScanFileResults(path string) ([]Result, error) {
+	results, _, err := ScanFileImage(path)
+	return results, err
+}
+
+// ScanFileImage scans the file at path like ScanFileResults, and also returns
+// the bytes that were scanned: the unpacked image of a UPX packed binary, or
+// the contents of the file. They can be passed on, e.g. to ReadRuntimeInfo,
+// instead of reading the file again.
+func ScanFileImage(path string) ([]Result, []byte, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't open file: %w", err)
+		return nil, nil, fmt.Errorf("couldn't open file: %w", err)
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, descriptorExt := range descriptorFileExts {
+		if ext != descriptorExt {
+			continue
+		}
+		results, err := parseDescriptorFile(data)
+		if err == nil {
+			return results, data, nil
+		}
+		debugPrintf("Couldn't parse %s as a descriptor file, scanning it instead: %v\n", path, err)
+	}
+
+	if IsUPX(data) {
+		// Files merely mentioning UPX, and unsupported filters or methods,
+		// are scanned as they are
+		unpacked, err := UnpackUPX(data)
+		if err == nil {
+			debugPrintf("Unpacked UPX binary: %d -> %d bytes\n", len(data), len(unpacked))
+			results := ScanResults(unpacked)
+			for i := range results {
+				results[i].Method = MethodUPX + "+" + results[i].Method
+			}
+			return results, unpacked, nil
+		}
+		debugPrintf("Couldn't unpack UPX binary %s, scanning it instead: %v\n", path, err)
 	}
-	return Scan(data), nil
+	return ScanResults(data), data, nil
 }
 
-// findValidStartWithLength searches backwards from index to find a valid Field 1 tag (0xa)
-// that correctly encodes the filename ending with ".proto"
-// Returns:
-// - start: the position of the 0xa tag (Field 1), or -1 if not found
-// - prefixLen: if there's a varint length prefix before start, this is the decoded length; 0 otherwise
-// - prefixBytes: the number of bytes used by the length prefix varint
-func findValidStartWithLength(data []byte, protoIndex int) (start int, prefixLen int, prefixBytes int) {
-	// The filename ends at protoIndex + len(".proto")
-	filenameEnd := protoIndex + len(scan)
+// parseDescriptorFile parses data as a serialized FileDescriptorSet, or failing
+// that as a single serialized FileDescriptorProto
+func parseDescriptorFile(data []byte) ([]Result, error) {
+	set := &DescriptorSet{Offset: 0, Length: len(data)}
+	results := make([]Result, 0)
+	for position := 0; position < len(data); {
+		number, wireType, n := protowire.ConsumeTag(data[position:])
+		if n < 0 {
+			results = nil
+			break
+		}
+		if number != 1 || wireType != protowire.BytesType {
+			m := protowire.ConsumeFieldValue(number, wireType, data[position+n:])
+			if m < 0 {
+				results = nil
+				break
+			}
+			position += n + m
+			continue
+		}
 
-	// Search backwards for potential start positions
-	searchStart := protoIndex
-	for searchStart > 0 {
-		// Find the previous 0xa byte
-		pos := bytes.LastIndexByte(data[:searchStart], magicByte)
-		if pos == -1 {
-			return -1, 0, 0
+		value, m := protowire.ConsumeBytes(data[position+n:])
+		if m < 0 || !isFileDescriptor(value) {
+			results = nil
+			break
 		}
+		results = append(results, Result{
+			Data:   value,
+			Offset: position + n + m - len(value),
+			Length: len(value),
+			Method: MethodDescriptorFile,
+			Set:    set,
+		})
+		position += n + m
+	}
 
-		debugPrintf("    Checking candidate 0xa at offset %d\n", pos)
+	if len(results) > 0 {
+		set.Files = len(results)
+		return results, nil
+	}
 
-		// After the 0xa tag, the next byte(s) should be the string length (varint)
-		// For simple cases, the length is a single byte
-		if pos+1 >= len(data) {
-			searchStart = pos
+	if isFileDescriptor(data) {
+		return []Result{{Data: data, Offset: 0, Length: len(data), Method: MethodDescriptorFile}}, nil
+	}
+	return nil, fmt.Errorf("not a FileDescriptorSet or FileDescriptorProto")
+}
+
+// isFileDescriptor reports whether data is a serialized FileDescriptorProto
+// named *.proto
+func isFileDescriptor(data []byte) bool {
+	var pb descriptorpb.FileDescriptorProto
+	if err := proto.Unmarshal(data, &pb); err != nil {
+		return false
+	}
+	return strings.HasSuffix(pb.GetName(), scan)
+}
+
+// findValidStart looks for the Field 1 tag (0xa) that correctly encodes the
+// filename ending with ".proto" at filenameEnd. runStart is the start of the
+// run of printable bytes containing the filename.
+//
+// The filename must be printable and the tag is not, so the tag can only sit
+// right before runStart, separated from it by at most the bytes of a two byte
+// length varint. That bounds the lookback to a handful of bytes regardless of
+// how far away the previous 0xa is; filenames needing a three byte varint
+// (16KiB and up) are not recognized.
+//
+// Returns the position of the 0xa tag (Field 1), or -1 if not found.
+func findValidStart(data []byte, filenameEnd int, runStart int) int {
+	for pos := runStart - 1; pos >= 0 && pos >= runStart-3; pos-- {
+		if data[pos] != magicByte {
 			continue
 		}
 
+		debugPrintf("    Checking candidate 0xa at offset %d\n", pos)
+
 		// Read the length varint after the 0xa
-		lengthBytes := data[pos+1:]
-		filenameLen, varintLen := protowire.ConsumeVarint(lengthBytes)
+		filenameLen, varintLen := protowire.ConsumeVarint(data[pos+1:])
 		if varintLen < 0 {
 			debugPrintf("    Failed to parse varint at offset %d\n", pos+1)
-			searchStart = pos
 			continue
 		}
 
-		debugPrintf("    Varint: length=%d, varintLen=%d\n", filenameLen, varintLen)
-
 		// Check if the computed filename end matches the actual ".proto" position
 		// Position after 0xa + varint length + filename length should point to after ".proto"
-		computedEnd := pos + 1 + varintLen + int(filenameLen)
-
-		debugPrintf("    Computed filename end: %d, actual end: %d\n", computedEnd, filenameEnd)
-
-		if computedEnd == filenameEnd {
-			// Additional validation: check that the filename contains only printable chars
-			filenameStart := pos + 1 + varintLen
-			if filenameStart < len(data) && filenameStart < filenameEnd {
-				filename := data[filenameStart:filenameEnd]
-				valid := true
-				for _, b := range filename {
-					if b < 0x20 || b > 0x7e {
-						valid = false
-						break
-					}
-				}
-				if valid {
-					debugPrintf("    Found valid start at offset %d, filename: %q\n", pos, string(filename))
-
-					// Check if there's a length prefix before this position
-					// Try to find a varint that could be a length prefix
-					// The length prefix should be large enough to contain at least the filename + some proto data
-					minValidLength := len(filename) + 50 // At minimum, filename + package + some structure
-
-					if pos >= 1 {
-						// Try different varint lengths (1-4 bytes), starting from longest
-						for tryLen := 4; tryLen >= 1 && pos >= tryLen; tryLen-- {
-							prefixStart := pos - tryLen
-							candidateLen, n := protowire.ConsumeVarint(data[prefixStart:])
-							if n == tryLen && int(candidateLen) >= minValidLength {
-								// Verify this is a reasonable length prefix
-								// The length should point to data that's within our bounds
-								expectedEnd := pos + int(candidateLen)
-								if expectedEnd <= len(data) {
-									debugPrintf("    Found valid length prefix at %d: %d bytes (ends at %d)\n",
-										prefixStart, candidateLen, expectedEnd)
-									return pos, int(candidateLen), n
-								}
-							}
-						}
-					}
+		filenameStart := pos + 1 + varintLen
+		computedEnd := filenameStart + int(filenameLen)
 
-					return pos, 0, 0
-				}
-			}
+		debugPrintf("    Varint: length=%d, varintLen=%d, computed filename end: %d, actual end: %d\n",
+			filenameLen, varintLen, computedEnd, filenameEnd)
+
+		if computedEnd != filenameEnd || filenameStart < runStart {
+			continue
 		}
 
-		// This 0xa is not the right one, continue searching backwards
-		searchStart = pos
+		debugPrintf("    Found valid start at offset %d, filename: %q\n", pos, string(data[filenameStart:filenameEnd]))
+		return pos
 	}
 
-	return -1, 0, 0
+	return -1
 }
 
-func Scan(data []byte) [][]byte {
-	results := make([][]byte, 0)
-	totalOffset := 0 // Track absolute offset for debugging
+// fieldNode is a position in the forest formed by parsing protobuf fields,
+// whose parent is the end of the field starting at the position. Roots are
+// positions where no field parses, e.g. the end of the data.
+type fieldNode struct {
+	// parent is -1 for roots
+	parent int
+	// jump is an ancestor allowing to skip up the tree in logarithmic time,
+	// following the skew-binary scheme of Myers' jump pointers
+	jump  int
+	depth int
+}
 
+// addFields parses fields from start until it reaches a known position or one
+// where no field parses, and adds the positions it went through to the forest
+func (sb *scanBuffer) addFields(start int) {
+	var path []int
+	position := start
+	root := false
 	for {
-		index := bytes.Index(data, []byte(scan))
-		if index == -1 {
+		if _, ok := sb.fields[position]; ok {
 			break
 		}
-
-		// Extract the filename for debugging
-		filenameEnd := index + len(scan)
-		filenameStart := index
-		for filenameStart > 0 && data[filenameStart-1] != 0x0a && data[filenameStart-1] >= 0x20 && data[filenameStart-1] <= 0x7e {
-			filenameStart--
+		path = append(path, position)
+		length := -1
+		if position < len(sb.data) {
+			_, _, length = protowire.ConsumeField(sb.data[position:])
+		}
+		if length <= 0 {
+			root = true
+			break
 		}
-		filename := string(data[filenameStart:filenameEnd])
-		debugPrintf("Found '.proto' at offset %d (absolute: %d), possible filename: %q\n",
-			index, totalOffset+index, filename)
+		position += length
+	}
 
-		// Find the valid start position using the improved algorithm
-		start, prefixLen, prefixBytes := findValidStartWithLength(data, index)
-		if start == -1 {
-			debugPrintf("  No valid start found, skipping\n")
-			data = data[index+1:]
-			totalOffset += index + 1
+	// Parents are added before their children
+	for i := len(path) - 1; i >= 0; i-- {
+		if root && i == len(path)-1 {
+			sb.fields[path[i]] = fieldNode{parent: -1, jump: path[i]}
 			continue
 		}
+		parentPosition := position
+		if i+1 < len(path) {
+			parentPosition = path[i+1]
+		}
+		parent := sb.fields[parentPosition]
+		node := fieldNode{parent: parentPosition, jump: parentPosition, depth: parent.depth + 1}
+		jump := sb.fields[parent.jump]
+		if parent.depth-jump.depth == jump.depth-sb.fields[jump.jump].depth {
+			node.jump = jump.jump
+		}
+		sb.fields[path[i]] = node
+	}
+}
+
+// fieldsEndAt reports whether the bytes from start parse as protobuf fields
+// ending exactly at end. Parsing is shared across calls, so overlapping
+// candidates don't walk the same fields again.
+func (sb *scanBuffer) fieldsEndAt(start int, end int) bool {
+	if start >= end || end > len(sb.data) {
+		return false
+	}
+	sb.addFields(start)
+	position := start
+	for position < end {
+		node := sb.fields[position]
+		if node.parent < 0 {
+			return false
+		}
+		if node.jump < end {
+			position = node.jump
+		} else {
+			position = node.parent
+		}
+	}
+	return position == end
+}
+
+// descriptorAt reports whether a FileDescriptorProto whose name is the first
+// field starts at start and ends exactly at end
+func (sb *scanBuffer) descriptorAt(start int, end int) bool {
+	number, wireType, n := protowire.ConsumeTag(sb.data[start:])
+	if n < 0 || number != 1 || wireType != protowire.BytesType {
+		return false
+	}
+	name, m := protowire.ConsumeBytes(sb.data[start+n:])
+	if m < 0 || !bytes.HasSuffix(name, []byte(scan)) {
+		return false
+	}
+	for _, b := range name {
+		if !isPrintable(b) {
+			return false
+		}
+	}
+	return sb.fieldsEndAt(start, end)
+}
 
-		debugPrintf("  Using start at offset %d, prefixLen=%d, prefixBytes=%d\n", start, prefixLen, prefixBytes)
+// lengthPrefix looks for a varint in the tryLen bytes before start holding the
+// length of the descriptor starting at start. It returns the decoded length, or
+// 0 if no prefix checks out.
+func (sb *scanBuffer) lengthPrefix(start int, tryLen int) int {
+	if start < tryLen {
+		return 0
+	}
+	length, n := protowire.ConsumeVarint(sb.data[start-tryLen:])
+	if n != tryLen || length == 0 || length > uint64(len(sb.data)-start) {
+		return 0
+	}
+	if !sb.descriptorAt(start, start+int(length)) {
+		return 0
+	}
+	return int(length)
+}
 
-		// Show some bytes around start for debugging
-		contextStart := start
-		if contextStart > 10 {
-			contextStart = start - 10
+// extractDescriptorSet checks whether the descriptor starting at start is an
+// element of a FileDescriptorSet, i.e. it's preceded by the tag and length of
+// Field 1 of FileDescriptorSet, and if so unpacks the elements that follow it
+// as a group. It returns nil if start isn't in a set.
+func (sb *scanBuffer) extractDescriptorSet(start int) ([]Result, int) {
+	data := sb.data
+	setStart := -1
+	// A varint length takes at most 5 bytes for the sizes we care about
+	for tryLen := 1; tryLen <= 5 && start-tryLen-1 >= 0; tryLen++ {
+		if data[start-tryLen-1] == magicByte && sb.lengthPrefix(start, tryLen) > 0 {
+			setStart = start - tryLen - 1
+			break
 		}
-		contextEnd := start + 30
-		if contextEnd > len(data) {
-			contextEnd = len(data)
+	}
+	if setStart == -1 {
+		return nil, 0
+	}
+
+	set := &DescriptorSet{Offset: setStart}
+	results := make([]Result, 0)
+	position := setStart
+	for position < len(data) && data[position] == magicByte {
+		length, n := protowire.ConsumeVarint(data[position+1:])
+		if n < 0 || length > uint64(len(data)) {
+			break
 		}
-		debugPrintf("  Bytes around start: %x\n", data[contextStart:contextEnd])
+		elementStart := position + 1 + n
+		elementEnd := elementStart + int(length)
+		if elementEnd > len(data) || !sb.descriptorAt(elementStart, elementEnd) {
+			break
+		}
+		results = append(results, Result{
+			Data:   data[elementStart:elementEnd],
+			Offset: elementStart,
+			Length: int(length),
+			Method: MethodDescriptorSet,
+			Set:    set,
+		})
+		position = elementEnd
+	}
+
+	set.Length = position - setStart
+	set.Files = len(results)
+	debugPrintf("  Found FileDescriptorSet at offset %d: %d files, %d bytes\n", set.Offset, set.Files, set.Length)
+	return results, position
+}
+
+// extractDescriptor tries to extract the file descriptor whose filename ends at
+// filenameEnd, along with the rest of its FileDescriptorSet if it's in one. It
+// returns the results and the position where scanning should resume, or nil if
+// there's no valid descriptor there.
+func (sb *scanBuffer) extractDescriptor(filenameEnd int, runStart int) ([]Result, int) {
+	data := sb.data
+	if DebugScan {
+		debugPrintf("Found '.proto' at offset %d, possible filename: %q\n",
+			filenameEnd-len(scan), string(data[runStart:filenameEnd]))
+	}
+
+	start := findValidStart(data, filenameEnd, runStart)
+	if start == -1 {
+		debugPrintf("  No valid start found, skipping\n")
+		return nil, 0
+	}
+
+	if results, next := sb.extractDescriptorSet(start); results != nil {
+		return results, next
+	}
 
-		var length int
+	// Check if there's a length prefix before this position that delimits
+	// exactly one descriptor. Try different varint lengths (1-4 bytes),
+	// starting from longest
+	length := 0
+	for tryLen := 4; tryLen >= 1 && length == 0; tryLen-- {
+		length = sb.lengthPrefix(start, tryLen)
+	}
+
+	if length > 0 {
+		debugPrintf("  Using length prefix: %d bytes\n", length)
+	} else {
+		// Fall back to consumeBytes for older/simpler formats
 		var err error
+		length, err = sb.consumeBytes(start)
+		debugPrintf("  consumeBytes returned length=%d, err=%v\n", length, err)
+		if err != nil {
+			return nil, 0
+		}
+	}
 
-		// If we have a valid length prefix, use it directly
-		if prefixLen > 0 && start+prefixLen <= len(data) {
-			length = prefixLen
-			debugPrintf("  Using length prefix: %d bytes\n", length)
-		} else {
-			// Fall back to consumeBytes for older/simpler formats
-			length, err = consumeBytes(data, start)
-			debugPrintf("  consumeBytes returned length=%d, err=%v\n", length, err)
-
-			if err != nil {
-				fmt.Printf("%v\n", err)
-				if len(data) > index {
-					data = data[index+1:]
-					totalOffset += index + 1
+	debugPrintf("  Extracted %d bytes from offset %d\n", length, start)
+	result := Result{Data: data[start : start+length], Offset: start, Length: length, Method: MethodRaw}
+	return []Result{result}, start + length
+}
+
+// extractGzip tries to decompress the gzip member starting at start. It returns
+// the decompressed bytes and the position right after the member, or nil if
+// there's no valid member there.
+func (sb *scanBuffer) extractGzip(start int) ([]byte, int) {
+	// Reserved flag bits must be zero
+	if start+3 < len(sb.data) && sb.data[start+3]&0xe0 != 0 {
+		return nil, 0
+	}
+
+	reader := bytes.NewReader(sb.data[start:])
+	var err error
+	if sb.gzip == nil {
+		sb.gzip, err = gzip.NewReader(reader)
+	} else {
+		err = sb.gzip.Reset(reader)
+	}
+	if err != nil {
+		return nil, 0
+	}
+	sb.gzip.Multistream(false)
+
+	payload, err := io.ReadAll(io.LimitReader(sb.gzip, maxGzipSize+1))
+	if err != nil || len(payload) > maxGzipSize {
+		debugPrintf("Skipping gzip member at offset %d: %v\n", start, err)
+		return nil, 0
+	}
+
+	end := len(sb.data) - reader.Len()
+	debugPrintf("Decompressed gzip member at offset %d: %d -> %d bytes\n", start, end-start, len(payload))
+	return payload, end
+}
+
+// scanData makes a single forward pass over data, feeding every byte to
+// anchorMatcher and keeping track of the current run of printable bytes, so
+// each anchor can be validated with bounded lookback.
+func scanData(data []byte, depth int) []Result {
+	results := make([]Result, 0)
+	sb := &scanBuffer{data: data, failed: make(map[int]bool), fields: make(map[int]fieldNode)}
+
+	state := int32(0)
+	runStart := 0 // Start of the run of printable bytes ending at pos
+	for pos := 0; pos < len(data); pos++ {
+		b := data[pos]
+		if !isPrintable(b) {
+			runStart = pos + 1
+		}
+
+		state = anchorMatcher.step(state, b)
+		for _, id := range anchorMatcher.matches(state) {
+			matchStart := pos + 1 - anchorMatcher.lens[id]
+
+			var found bool
+			var next int
+			switch id {
+			case anchorProto:
+				var extracted []Result
+				extracted, next = sb.extractDescriptor(pos+1, runStart)
+				found = extracted != nil
+				results = append(results, extracted...)
+			case anchorGzip:
+				if depth >= maxScanDepth {
 					continue
-				} else {
-					break
+				}
+				var payload []byte
+				payload, next = sb.extractGzip(matchStart)
+				found = payload != nil
+				if found {
+					for _, result := range scanData(payload, depth+1) {
+						if result.Method == MethodRaw {
+							result.Method = MethodGzip
+						} else {
+							result.Method = MethodGzip + "+" + result.Method
+						}
+						result.Offset = matchStart
+						result.Length = next - matchStart
+						results = append(results, result)
+					}
 				}
 			}
-		}
 
-		debugPrintf("  Extracted %d bytes from offset %d\n", length, start)
-		results = append(results, data[start:start+length])
-		data = data[start+length:]
-		totalOffset += start + length
+			if found && next > pos {
+				// Resume right after the extracted data
+				pos = next - 1
+				state = 0
+				runStart = next
+				break
+			}
+		}
 	}
 
 	return results
 }
+
+// ScanResults finds serialized file descriptors in data, including gzip
+// compressed ones and whole FileDescriptorSets. It runs in time linear in the
+// size of data, up to a logarithmic factor for validating length prefixes.
+func ScanResults(data []byte) []Result {
+	results := scanData(data, 0)
+	if len(results) > 0 {
+		packages := FindGoPackages(data)
+		layout := readLayout(data)
+		for i := range results {
+			results[i].GoPackage = packages.Lookup(descriptorName(results[i].Data))
+			results[i].Location = layout.locate(results[i].Offset)
+		}
+	}
+	return results
+}
+
+// Scan finds serialized file descriptors in data, see ScanResults
+func Scan(data []byte) [][]byte {
+	return resultsData(ScanResults(data))
+}
@@ -1 +1,173 @@
 package protodump
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func descriptorBytes(t testing.TB) []byte {
+	data, err := proto.Marshal(protodesc.ToFileDescriptorProto(descriptorpb.File_google_protobuf_descriptor_proto))
+	assert.NoError(t, err)
+	return data
+}
+
+func gzipBytes(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestScan(t *testing.T) {
+	descriptor := descriptorBytes(t)
+	padding := make([]byte, 64)
+
+	t.Run("raw", func(t *testing.T) {
+		data := bytes.Join([][]byte{[]byte("garbage.proto"), padding, descriptor, padding}, nil)
+		assert.Equal(t, [][]byte{descriptor}, Scan(data))
+	})
+
+	t.Run("trailing fields", func(t *testing.T) {
+		// Bytes after the descriptor that parse as fields FileDescriptorProto
+		// doesn't have: a varint service, a fixed64 extension and a field 31
+		trailing := []byte{0x30, 0x00, 0x39, 0x00, 0x01, 0x00, 0xb2, 0x00, 0xb3, 0x00, 0x01, 0xfd, 0x01, 0x01, 0x00, 0xe0, 0x02}
+		for i := 0; i < len(trailing); {
+			_, _, n := protowire.ConsumeField(trailing[i:])
+			data := bytes.Join([][]byte{[]byte("garbage.proto"), padding, descriptor, trailing[i:], padding}, nil)
+			assert.Equal(t, [][]byte{descriptor}, Scan(data))
+			i += n
+		}
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		data := bytes.Join([][]byte{padding, gzipBytes(t, descriptor), padding}, nil)
+		assert.Equal(t, [][]byte{descriptor}, Scan(data))
+	})
+
+	t.Run("multiple", func(t *testing.T) {
+		data := bytes.Join([][]byte{padding, descriptor, padding, descriptor, padding}, nil)
+		assert.Equal(t, [][]byte{descriptor, descriptor}, Scan(data))
+	})
+
+	t.Run("long filename", func(t *testing.T) {
+		name := strings.Repeat("a", 300) + ".proto"
+		data, err := proto.Marshal(&descriptorpb.FileDescriptorProto{Name: proto.String(name)})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{data}, Scan(bytes.Join([][]byte{padding, data, padding}, nil)))
+	})
+}
+
+func TestScanDescriptorSet(t *testing.T) {
+	files := []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(descriptorpb.File_google_protobuf_descriptor_proto),
+		protodesc.ToFileDescriptorProto(timestamppb.File_google_protobuf_timestamp_proto),
+		protodesc.ToFileDescriptorProto(durationpb.File_google_protobuf_duration_proto),
+	}
+	set, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: files})
+	assert.NoError(t, err)
+
+	expected := make([][]byte, len(files))
+	for i, file := range files {
+		expected[i], err = proto.Marshal(file)
+		assert.NoError(t, err)
+	}
+
+	t.Run("embedded", func(t *testing.T) {
+		padding := make([]byte, 64)
+		results := ScanResults(bytes.Join([][]byte{padding, set, padding}, nil))
+		assert.Equal(t, expected, resultsData(results))
+		for _, result := range results {
+			assert.Equal(t, MethodDescriptorSet, result.Method)
+			assert.Equal(t, &DescriptorSet{Offset: len(padding), Length: len(set), Files: len(files)}, result.Set)
+			assert.Same(t, results[0].Set, result.Set)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "api.protoset")
+		assert.NoError(t, os.WriteFile(path, set, 0600))
+		results, image, err := ScanFileImage(path)
+		assert.NoError(t, err)
+		assert.Equal(t, set, image)
+		assert.Equal(t, expected, resultsData(results))
+		for _, result := range results {
+			assert.Equal(t, MethodDescriptorFile, result.Method)
+			assert.Equal(t, len(files), result.Set.Files)
+		}
+	})
+
+	t.Run("single file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "api.pb")
+		assert.NoError(t, os.WriteFile(path, expected[1], 0600))
+		data, err := ScanFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{expected[1]}, data)
+	})
+}
+
+// adversarialInputs returns inputs of the given size that made the previous
+// backwards-searching scanner quadratic.
+func adversarialInputs(size int) map[string][]byte {
+	return map[string][]byte{
+		// Every hit used to walk back to the single 0xa at the start
+		"distant-tag": append([]byte{magicByte}, bytes.Repeat([]byte("x.proto"), size/7)...),
+		// Build logs and source archives: lines full of .proto paths
+		"build-log": bytes.Repeat([]byte("protoc --go_out=. api/v1/service.proto\n"), size/40),
+		// Valid looking tags in front of filenames that never check out
+		"bad-tags": bytes.Repeat([]byte("\x0a\x7fa.proto\x12\xff"), size/11),
+		// Length prefixes claiming half of the input in front of every
+		// filename, which used to be validated by parsing that far each time
+		"long-prefix": longPrefixInput(size),
+		// Truncated gzip headers everywhere
+		"gzip-magic": bytes.Repeat([]byte{0x1f, 0x8b, 0x08, 0x00}, size/4),
+	}
+}
+
+// longPrefixInput repeats a field whose varint is read as the length
+// of the descriptor that follows, up to the middle of the input
+func longPrefixInput(size int) []byte {
+	unit := protowire.AppendVarint([]byte{0x12, 0x03}, uint64(size/2+3))
+	unit = append(unit, "\x0a\x07x.proto"...)
+	return bytes.Repeat(unit, size/len(unit))
+}
+
+func BenchmarkScanAdversarial(b *testing.B) {
+	for _, size := range []int{1 << 16, 1 << 18, 1 << 20, 1 << 22} {
+		for name, data := range adversarialInputs(size) {
+			b.Run(fmt.Sprintf("%s/%d", name, size), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					Scan(data)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkScanDescriptors(b *testing.B) {
+	descriptor := descriptorBytes(b)
+	for _, count := range []int{16, 64, 256} {
+		data := bytes.Repeat(append(make([]byte, 1024), descriptor...), count)
+		b.Run(fmt.Sprintf("%d", count), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				Scan(data)
+			}
+		})
+	}
+}
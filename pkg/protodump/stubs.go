@@ -0,0 +1,338 @@
+package protodump
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// stubType is a type the batch references but doesn't declare
+type stubType struct {
+	name protoreflect.FullName
+	enum bool
+	// values are the enum values named by field defaults
+	values []string
+	// extended marks messages extended by the batch, which need an
+	// extension range
+	extended bool
+	// files are the files referencing the type
+	files []string
+}
+
+// Stubs returns a stand-in for every import of the batch that wasn't found,
+// so the dump can still be compiled. Each stub declares the types the batch
+// references from it, inferred from how they are used: messages, enums with
+// the values named by defaults, and extension ranges for extended messages.
+// The package of a type is taken to be its components up to the first one
+// starting with an upper case letter.
+//
+// Stubs are proto3, so that proto3 files can use their enums. Only proto2
+// messages can be extended though, so extended messages and the types nested
+// in them are declared in a proto2 stub of their own, e.g.
+// common/types_extended.proto, which the stub imports publicly.
+func (b *Batch) Stubs() []*ProtoDefinition {
+	files := make(map[string]bool)
+	for _, definition := range b.Definitions {
+		if definition != nil {
+			files[definition.pb.GetName()] = true
+		}
+	}
+
+	// Imports that were found but couldn't be built aren't missing
+	var missing []string
+	for _, imports := range b.Registry.UnresolvedImports() {
+		for _, fileImport := range imports {
+			if !files[fileImport] && !contains(missing, fileImport) {
+				missing = append(missing, fileImport)
+			}
+		}
+	}
+	sort.Strings(missing)
+
+	types := make(map[protoreflect.FullName]*stubType)
+	var order []protoreflect.FullName
+	reference := func(file string, typeName string, enum bool) *stubType {
+		name := protoreflect.FullName(strings.TrimPrefix(typeName, "."))
+		if _, err := b.Registry.files.FindDescriptorByName(name); err == nil || name == "" {
+			return nil
+		}
+		t, ok := types[name]
+		if !ok {
+			t = &stubType{name: name, enum: enum}
+			types[name] = t
+			order = append(order, name)
+		}
+		if !contains(t.files, file) {
+			t.files = append(t.files, file)
+		}
+		return t
+	}
+	for _, definition := range b.Definitions {
+		if definition != nil {
+			collectStubTypes(definition.pb, reference)
+		}
+	}
+
+	// Types are placed by package, in a missing import of every file that
+	// references the package
+	stubs := make(map[string]*descriptorpb.FileDescriptorProto)
+	packageFiles := make(map[string][]string)
+	var packages []string
+	for _, name := range order {
+		packageName, _ := splitTypeName(name)
+		if _, ok := packageFiles[packageName]; !ok {
+			packages = append(packages, packageName)
+		}
+		for _, file := range types[name].files {
+			if !contains(packageFiles[packageName], file) {
+				packageFiles[packageName] = append(packageFiles[packageName], file)
+			}
+		}
+	}
+	sort.Strings(packages)
+	placed := make(map[string]string)
+	for _, packageName := range packages {
+		stub := ""
+		for _, candidate := range b.Registry.UnresolvedImports()[packageFiles[packageName][0]] {
+			if !contains(missing, candidate) || stubs[candidate] != nil {
+				continue
+			}
+			importedByAll := true
+			for _, file := range packageFiles[packageName][1:] {
+				importedByAll = importedByAll && contains(b.Registry.UnresolvedImports()[file], candidate)
+			}
+			if importedByAll {
+				stub = candidate
+				break
+			}
+		}
+		if stub == "" {
+			debugPrintf("Couldn't place the types of package %s in a stub\n", packageName)
+			continue
+		}
+		stubs[stub] = &descriptorpb.FileDescriptorProto{
+			Name:           proto.String(stub),
+			Syntax:         proto.String("proto3"),
+			SourceCodeInfo: &descriptorpb.SourceCodeInfo{},
+		}
+		if packageName != "" {
+			stubs[stub].Package = proto.String(packageName)
+		}
+		placed[packageName] = stub
+	}
+
+	extendedRoots := make(map[protoreflect.FullName]bool)
+	for _, name := range order {
+		if types[name].extended {
+			extendedRoots[stubRoot(name)] = true
+		}
+	}
+	extendedStubs := make(map[string]*descriptorpb.FileDescriptorProto)
+	for _, name := range order {
+		packageName, _ := splitTypeName(name)
+		stub, ok := placed[packageName]
+		if !ok {
+			continue
+		}
+		file := stubs[stub]
+		if extendedRoots[stubRoot(name)] {
+			if extendedStubs[stub] == nil {
+				extendedStubs[stub] = &descriptorpb.FileDescriptorProto{
+					Name:           proto.String(strings.TrimSuffix(stub, ".proto") + "_extended.proto"),
+					Package:        file.Package,
+					Syntax:         proto.String("proto2"),
+					SourceCodeInfo: &descriptorpb.SourceCodeInfo{},
+				}
+				file.Dependency = append(file.Dependency, extendedStubs[stub].GetName())
+				file.PublicDependency = append(file.PublicDependency, int32(len(file.Dependency)-1))
+			}
+			file = extendedStubs[stub]
+		}
+		addStubType(file, types[name])
+	}
+
+	var definitions []*ProtoDefinition
+	registry := &protoregistry.Files{}
+	build := func(pb *descriptorpb.FileDescriptorProto, header []string) *ProtoDefinition {
+		// The comments on the stub types have no span, which protodesc rejects
+		withoutSource := proto.Clone(pb).(*descriptorpb.FileDescriptorProto)
+		withoutSource.SourceCodeInfo = nil
+		fileOptions := protodesc.FileOptions{AllowUnresolvable: true}
+		descriptor, err := fileOptions.New(withoutSource, registry)
+		if err != nil {
+			debugPrintf("Couldn't build stub %s: %v\n", pb.GetName(), err)
+			return nil
+		}
+		if err := registry.RegisterFile(descriptor); err != nil {
+			debugPrintf("Couldn't register stub %s: %v\n", pb.GetName(), err)
+		}
+		definition := newDefinition(pb, descriptor, nil)
+		definition.SetHeader(header)
+		return definition
+	}
+	for _, stub := range missing {
+		// The extended messages are built first, as the stub imports them
+		var extended *ProtoDefinition
+		if pb := extendedStubs[stub]; pb != nil {
+			extended = build(pb, []string{
+				"Stub generated by protodump, " + stub + " wasn't found in the dump.",
+				"Declares the messages the dump extends, which have to be proto2, and is imported by " + stub + ".",
+			})
+		}
+		pb := stubs[stub]
+		if pb == nil {
+			pb = &descriptorpb.FileDescriptorProto{Name: proto.String(stub), Syntax: proto.String("proto3")}
+		}
+		definition := build(pb, []string{
+			"Stub generated by protodump, " + stub + " wasn't found in the dump.",
+			"Only the types referenced by the dump are declared, inferred from how they are used.",
+		})
+		for _, d := range []*ProtoDefinition{definition, extended} {
+			if d != nil {
+				definitions = append(definitions, d)
+			}
+		}
+	}
+	return definitions
+}
+
+// stubRoot returns the top-level type enclosing the type name, or the type
+// itself
+func stubRoot(name protoreflect.FullName) protoreflect.FullName {
+	packageName, names := splitTypeName(name)
+	if packageName == "" {
+		return protoreflect.FullName(names[0])
+	}
+	return protoreflect.FullName(packageName + "." + names[0])
+}
+
+// collectStubTypes calls reference for every type referenced by file
+func collectStubTypes(file *descriptorpb.FileDescriptorProto, reference func(file string, typeName string, enum bool) *stubType) {
+	name := file.GetName()
+	addField := func(field *descriptorpb.FieldDescriptorProto) {
+		if field.GetTypeName() != "" {
+			enum := field.GetType() == descriptorpb.FieldDescriptorProto_TYPE_ENUM
+			if t := reference(name, field.GetTypeName(), enum); t != nil && enum && field.GetDefaultValue() != "" &&
+				!contains(t.values, field.GetDefaultValue()) {
+				t.values = append(t.values, field.GetDefaultValue())
+			}
+		}
+		if field.GetExtendee() != "" {
+			if t := reference(name, field.GetExtendee(), false); t != nil {
+				t.extended = true
+			}
+		}
+	}
+	var addMessages func(messages []*descriptorpb.DescriptorProto)
+	addMessages = func(messages []*descriptorpb.DescriptorProto) {
+		for _, message := range messages {
+			for _, field := range message.GetField() {
+				addField(field)
+			}
+			for _, field := range message.GetExtension() {
+				addField(field)
+			}
+			addMessages(message.GetNestedType())
+		}
+	}
+	addMessages(file.GetMessageType())
+	for _, field := range file.GetExtension() {
+		addField(field)
+	}
+	for _, service := range file.GetService() {
+		for _, method := range service.GetMethod() {
+			reference(name, method.GetInputType(), false)
+			reference(name, method.GetOutputType(), false)
+		}
+	}
+}
+
+// splitTypeName splits a type name into its package and the names of the
+// type and the messages it is nested in
+func splitTypeName(name protoreflect.FullName) (string, []string) {
+	parts := strings.Split(string(name), ".")
+	i := 0
+	for i < len(parts)-1 && (parts[i] == "" || !unicode.IsUpper([]rune(parts[i])[0])) {
+		i++
+	}
+	return strings.Join(parts[:i], "."), parts[i:]
+}
+
+// addStubType declares t in file, along with the messages it is nested in
+func addStubType(file *descriptorpb.FileDescriptorProto, t *stubType) {
+	_, names := splitTypeName(t.name)
+	comment := " Stub for " + string(t.name) + ", referenced by " + strings.Join(t.files, ", ") + "\n"
+
+	messages, enums := &file.MessageType, &file.EnumType
+	var path []int32
+	messagesField, enumsField := int32(4), int32(5) // message_type and enum_type in FileDescriptorProto
+	for _, name := range names[:len(names)-1] {
+		i := stubMessage(messages, name)
+		path = append(path, messagesField, int32(i))
+		parent := (*messages)[i]
+		messages, enums = &parent.NestedType, &parent.EnumType
+		messagesField, enumsField = 3, 4 // nested_type and enum_type in DescriptorProto
+	}
+	name := names[len(names)-1]
+
+	if t.enum {
+		// The first value of an open enum has to be zero. Enum values share
+		// the scope of their enum, so the placeholder is prefixed with the
+		// enum's name as is.
+		enum := &descriptorpb.EnumDescriptorProto{Name: proto.String(name)}
+		values := append([]string{name + "_UNSPECIFIED"}, t.values...)
+		for i, value := range values {
+			if i > 0 && value == values[0] {
+				continue
+			}
+			enum.Value = append(enum.Value, &descriptorpb.EnumValueDescriptorProto{
+				Name:   proto.String(value),
+				Number: proto.Int32(int32(len(enum.Value))),
+			})
+		}
+		*enums = append(*enums, enum)
+		path = append(path, enumsField, int32(len(*enums)-1))
+	} else {
+		i := stubMessage(messages, name)
+		path = append(path, messagesField, int32(i))
+		if t.extended {
+			// The file is the proto2 stub of extended messages
+			(*messages)[i].ExtensionRange = append((*messages)[i].ExtensionRange, &descriptorpb.DescriptorProto_ExtensionRange{
+				Start: proto.Int32(1),
+				End:   proto.Int32(int32(protowire.MaxValidNumber) + 1),
+			})
+		}
+	}
+	file.SourceCodeInfo.Location = append(file.SourceCodeInfo.Location, &descriptorpb.SourceCodeInfo_Location{
+		Path:            path,
+		LeadingComments: proto.String(comment),
+	})
+}
+
+// stubMessage returns the index of the message called name, adding it when
+// missing
+func stubMessage(messages *[]*descriptorpb.DescriptorProto, name string) int {
+	for i, message := range *messages {
+		if message.GetName() == name {
+			return i
+		}
+	}
+	*messages = append(*messages, &descriptorpb.DescriptorProto{Name: proto.String(name)})
+	return len(*messages) - 1
+}
+
+func contains(list []string, s string) bool {
+	for _, element := range list {
+		if element == s {
+			return true
+		}
+	}
+	return false
+}
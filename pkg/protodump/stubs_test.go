@@ -0,0 +1,76 @@
+package protodump
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStubs(t *testing.T) {
+	dir := path.Join("testdata", "stubs")
+	files, err := convertProtoToFileDescriptors(path.Join(dir, "catalog.proto"), "--proto_path="+dir, "--include_imports")
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 4) {
+		return
+	}
+
+	// Leave out common/event.proto and common/types.proto, like a binary
+	// that doesn't link them in
+	batch := NewBatch(files[2:])
+	stubs := batch.Stubs()
+	if !assert.Len(t, stubs, 2) {
+		return
+	}
+	assert.Equal(t, "common/types.proto", stubs[0].Filename())
+	assert.Equal(t, `// Stub generated by protodump, common/types.proto wasn't found in the dump.
+// Only the types referenced by the dump are declared, inferred from how they are used.
+
+syntax = "proto3";
+
+package common;
+
+import public "common/types_extended.proto";
+
+// Stub for common.Money, referenced by shop.proto
+message Money {
+}
+
+// Stub for common.Currency, referenced by shop.proto, catalog.proto
+enum Currency {
+  Currency_UNSPECIFIED = 0;
+  EUR = 1;
+}
+
+`, stubs[0].String())
+	assert.Equal(t, "common/types_extended.proto", stubs[1].Filename())
+	assert.Equal(t, `// Stub generated by protodump, common/types.proto wasn't found in the dump.
+// Declares the messages the dump extends, which have to be proto2, and is imported by common/types.proto.
+
+syntax = "proto2";
+
+package common;
+
+// Stub for common.Event, referenced by shop.proto
+message Event {
+  // Stub for common.Event.Detail, referenced by shop.proto
+  message Detail {
+  }
+
+  extensions 1 to max;
+}
+
+`, stubs[1].String())
+
+	// The dump, proto2 and proto3 alike, compiles against the stubs
+	out, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(out)
+	assert.NoError(t, os.MkdirAll(path.Join(out, "common"), 0700))
+	for _, definition := range append(stubs, batch.Definitions...) {
+		assert.NoError(t, os.WriteFile(path.Join(out, definition.FileDescriptorProto().GetName()), []byte(definition.String()), 0600))
+	}
+	_, err = convertProtoToFileDescriptor(path.Join(out, "catalog.proto"), "--proto_path="+out)
+	assert.NoError(t, err)
+}
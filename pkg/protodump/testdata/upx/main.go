@@ -0,0 +1,15 @@
+// Command upx is packed with UPX by `make upx-testdata` to check that the
+// scanner recovers descriptors from real UPX output
+package main
+
+import (
+	_ "embed"
+	"fmt"
+)
+
+//go:embed render_options.pb
+var descriptorSet []byte
+
+func main() {
+	fmt.Println(len(descriptorSet))
+}
@@ -0,0 +1,104 @@
+package protodump
+
+import (
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// UnknownField is a field of the FileDescriptorProto that the descriptor.proto
+// linked into protodump doesn't know, typically written by a newer protoc
+type UnknownField struct {
+	// Path locates the element holding the field, e.g.
+	// `message_type[0].field[1].options`, empty for the file itself
+	Path string
+	// Number is the field number, zero when the data couldn't be parsed
+	Number protowire.Number
+	// Value is the field's value dumped from the wire format
+	Value string
+}
+
+func (u UnknownField) String() string {
+	path := u.Path
+	if path == "" {
+		path = "file"
+	}
+	return path + ": (" + strconv.Itoa(int(u.Number)) + ") = " + u.Value
+}
+
+// UnknownFields returns the unknown fields anywhere in the descriptor. Custom
+// options are only included when their extension can't be resolved, see
+// SetExtensionResolver.
+func (pd *ProtoDefinition) UnknownFields() []UnknownField {
+	var unknown []UnknownField
+	var walk func(message protoreflect.Message, path string)
+	walk = func(message protoreflect.Message, path string) {
+		for _, entry := range rawEntries(message.GetUnknown()) {
+			field := UnknownField{Path: path, Value: entry.value}
+			if len(entry.path) > 0 {
+				field.Number = protowire.Number(entry.path[0])
+			}
+			unknown = append(unknown, field)
+		}
+
+		message.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+			if field.Message() == nil || field.IsMap() {
+				return true
+			}
+			name := string(field.Name())
+			if field.IsExtension() {
+				name = "(" + string(field.FullName()) + ")"
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			if field.IsList() {
+				list := value.List()
+				for i := 0; i < list.Len(); i++ {
+					walk(list.Get(i).Message(), name+"["+strconv.Itoa(i)+"]")
+				}
+			} else if field.Name() == "options" {
+				// Custom options are unknown fields until resolved
+				walk(pd.resolveOptions(value.Message().Interface()).ProtoReflect(), name)
+			} else {
+				walk(value.Message(), name)
+			}
+			return true
+		})
+	}
+	walk(pd.pb.ProtoReflect(), "")
+	return unknown
+}
+
+// unknownEntries returns the unknown fields of the element at path, which
+// options don't already cover
+func (pd *ProtoDefinition) unknownEntries(path ...int32) []optionEntry {
+	message := pd.protoAt(path)
+	if message == nil {
+		return nil
+	}
+	entries := rawEntries(message.GetUnknown())
+	for i := range entries {
+		entries[i].descriptor = true
+	}
+	return entries
+}
+
+// protoAt returns the element of the FileDescriptorProto at the
+// SourceCodeInfo path, or nil
+func (pd *ProtoDefinition) protoAt(path []int32) protoreflect.Message {
+	message := pd.pb.ProtoReflect()
+	for i := 0; i+1 < len(path); i += 2 {
+		field := message.Descriptor().Fields().ByNumber(protoreflect.FieldNumber(path[i]))
+		if field == nil || !field.IsList() || field.Message() == nil {
+			return nil
+		}
+		list := message.Get(field).List()
+		if int(path[i+1]) >= list.Len() {
+			return nil
+		}
+		message = list.Get(int(path[i+1])).Message()
+	}
+	return message
+}
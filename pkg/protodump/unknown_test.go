@@ -0,0 +1,87 @@
+package protodump
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestUnknownFields(t *testing.T) {
+	descriptor, err := convertProtoToFileDescriptor(path.Join("testdata", "render_options.proto"))
+	assert.NoError(t, err)
+
+	// Fields a newer descriptor.proto could add, and an unknown custom option
+	addVarint := func(message proto.Message, number protowire.Number, v uint64) {
+		unknown := protowire.AppendTag(message.ProtoReflect().GetUnknown(), number, protowire.VarintType)
+		message.ProtoReflect().SetUnknown(protowire.AppendVarint(unknown, v))
+	}
+	addVarint(descriptor, 100, 1)
+	request := descriptor.GetMessageType()[0]
+	addVarint(request, 101, 2)
+	addVarint(request.GetField()[0], 102, 3)
+	addVarint(request.GetEnumType()[0].GetValue()[1], 103, 4)
+	addVarint(descriptor.GetService()[0].GetMethod()[0], 104, 5)
+	descriptor.GetMessageType()[1].Options = &descriptorpb.MessageOptions{}
+	addVarint(descriptor.GetMessageType()[1].Options, 50000, 6)
+	// The unknown fields of the file follow its options and imports
+	descriptor.Dependency = append(descriptor.Dependency, "google/protobuf/empty.proto")
+
+	actual, err := NewFromDescriptor(descriptor)
+	assert.NoError(t, err)
+	assert.Equal(t, []UnknownField{
+		{Path: "", Number: 100, Value: "1"},
+		{Path: "message_type[0]", Number: 101, Value: "2"},
+		{Path: "message_type[0].field[0]", Number: 102, Value: "3"},
+		{Path: "message_type[0].enum_type[0].value[1]", Number: 103, Value: "4"},
+		{Path: "message_type[1].options", Number: 50000, Value: "6"},
+		{Path: "service[0].method[0]", Number: 104, Value: "5"},
+	}, actual.UnknownFields())
+	assert.Equal(t, "message_type[0].field[0]: (102) = 3", actual.UnknownFields()[2].String())
+
+	output := actual.String()
+	assert.Contains(t, output, "option go_package = \"./;helloworld\";\n\nimport \"google/protobuf/empty.proto\";\n\n// unknown descriptor field (100) = 1;\n\n")
+	assert.Contains(t, output, "message HelloRequest {\n  // unknown descriptor field (101) = 2;\n")
+	assert.Contains(t, output, "string name = 3 /* unknown descriptor field (102) = 3 */;")
+	assert.Contains(t, output, "KIND_B = 2 /* unknown descriptor field (103) = 4 */;")
+	assert.Contains(t, output, "rpc SayHello (.hello.world.HelloRequest) returns (.hello.world.HelloReply) {\n    // unknown descriptor field (104) = 5;\n  }")
+	assert.Contains(t, output, "message HelloReply {\n  // unresolved option (50000) = 6;\n")
+}
+
+func TestUnknownNestedFields(t *testing.T) {
+	addVarint := func(unknown []byte, number protowire.Number, v uint64) []byte {
+		return protowire.AppendVarint(protowire.AppendTag(unknown, number, protowire.VarintType), v)
+	}
+
+	// A feature of a newer descriptor.proto
+	descriptor, err := convertProtoToFileDescriptor(path.Join(FIXTURES, "editions.edition2023"))
+	assert.NoError(t, err)
+	features := descriptor.GetOptions().GetFeatures().ProtoReflect()
+	features.SetUnknown(addVarint(features.GetUnknown(), 12, 2))
+
+	actual, err := NewFromDescriptor(descriptor)
+	assert.NoError(t, err)
+	assert.Equal(t, []UnknownField{{Path: "options.features", Number: 12, Value: "2"}}, actual.UnknownFields())
+	assert.Contains(t, actual.String(), "option features.utf8_validation = NONE;\n// unknown descriptor field features.(12) = 2;\n")
+	assert.Equal(t, []Diagnostic{
+		{Element: "fixtures/editions.edition2023", Message: "descriptor field features.(12) is unknown and only kept as a comment"},
+	}, actual.Diagnostics())
+
+	// A field of a newer version of a custom option's message
+	descriptor, err = convertProtoToFileDescriptor(path.Join(FIXTURES, "custom_options.proto2"))
+	assert.NoError(t, err)
+	options := descriptor.GetMessageType()[1].GetOptions().ProtoReflect()
+	unknown := protowire.AppendTag(options.GetUnknown(), 50001, protowire.BytesType)
+	options.SetUnknown(protowire.AppendBytes(unknown, addVarint(nil, 12, 2)))
+
+	actual, err = NewFromDescriptor(descriptor)
+	assert.NoError(t, err)
+	actual.SetExtensionResolver(NewRegistry([]*descriptorpb.FileDescriptorProto{descriptor}))
+	assert.Contains(t, actual.String(), `limits { key: "d" value: 4 } /* unknown field (12) = 2 */ };`)
+	assert.Contains(t, actual.Diagnostics(), Diagnostic{
+		Element: "hello.world.Account", Message: "field (12) of option (hello.world.message_rule) is unknown and only kept as a comment",
+	})
+}
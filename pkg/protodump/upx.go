@@ -0,0 +1,499 @@
+package protodump
+
+import (
+	"bytes"
+	"compress/flate"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// ErrNotUPX is returned by UnpackUPX when the input isn't a UPX packed ELF binary
+var ErrNotUPX = errors.New("not a UPX packed ELF binary")
+
+var upxMagic = []byte("UPX!")
+
+// UPX compression methods, see src/conf.h in the UPX sources
+const (
+	upxNRV2BLE32 = 2
+	upxNRV2B8    = 3
+	upxNRV2BLE16 = 4
+	upxNRV2DLE32 = 5
+	upxNRV2D8    = 6
+	upxNRV2DLE16 = 7
+	upxNRV2ELE32 = 8
+	upxNRV2E8    = 9
+	upxNRV2ELE16 = 10
+	upxLZMA      = 14
+	upxDeflate   = 15
+)
+
+const (
+	// upxInfoLen is the size of each of the l_info, p_info and b_info headers
+	upxInfoLen = 12
+	// upxHeaderSearch bounds where the l_info header is looked for
+	upxHeaderSearch = 8192
+	// maxUPXSize caps the total unpacked size
+	maxUPXSize = 1 << 30
+	// maxUPXRatio caps how many times larger than its compressed data a
+	// block, or the whole image, may claim to be. Sizes come from headers that
+	// could be garbage, and are checked against it before allocating. Deflate
+	// tops out at 1032:1, and LZMA stays below this on runs of zeros.
+	maxUPXRatio = 1 << 13
+)
+
+// upxBlock mirrors the b_info header in front of every compressed block
+type upxBlock struct {
+	uncompressedSize uint32
+	compressedSize   uint32
+	method           byte
+	filter           byte
+}
+
+func upxSearchWindow(data []byte) []byte {
+	if len(data) > upxHeaderSearch {
+		return data[:upxHeaderSearch]
+	}
+	return data
+}
+
+// IsUPX reports whether data looks like a UPX packed ELF binary
+func IsUPX(data []byte) bool {
+	if !bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		return false
+	}
+	return bytes.Contains(upxSearchWindow(data), upxMagic)
+}
+
+// UnpackUPX decompresses a UPX packed ELF binary in memory and returns the
+// concatenated contents of all its compressed blocks. The result is not a
+// runnable executable, but it holds the original file contents in order, which
+// is all the scanner needs.
+//
+// Blocks using the NRV2B, NRV2D, NRV2E, LZMA and deflate methods are supported.
+// Filters (b_ftid) are not undone: UPX only applies them to executable
+// segments, while descriptors live in read-only data.
+func UnpackUPX(data []byte) ([]byte, error) {
+	if !IsUPX(data) || len(data) <= elf.EI_DATA {
+		return nil, ErrNotUPX
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if elf.Data(data[elf.EI_DATA]) == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+
+	// l_info is {checksum, magic, lsize, version, format} and is directly
+	// followed by p_info {progid, filesize, blocksize} and the first b_info
+	search := upxSearchWindow(data)
+	var lastErr error = ErrNotUPX
+	for offset := 0; ; {
+		index := bytes.Index(search[offset:], upxMagic)
+		if index == -1 {
+			return nil, lastErr
+		}
+		magic := offset + index
+		offset = magic + 1
+
+		linfo := magic - 4
+		if linfo < 0 || magic+2*upxInfoLen > len(data) {
+			continue
+		}
+		pinfo := linfo + upxInfoLen
+		fileSize := order.Uint32(data[pinfo+4:])
+		blockSize := order.Uint32(data[pinfo+8:])
+		if fileSize == 0 || fileSize > maxUPXSize || blockSize == 0 || blockSize > maxUPXSize {
+			continue
+		}
+		if int64(fileSize) > int64(len(data))*maxUPXRatio {
+			continue
+		}
+
+		debugPrintf("Found UPX l_info at offset %d: filesize=%d, blocksize=%d\n", linfo, fileSize, blockSize)
+		unpacked, err := unpackUPXBlocks(data, pinfo+upxInfoLen, order, blockSize)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return unpacked, nil
+	}
+}
+
+func readUPXBlock(data []byte, position int, order binary.ByteOrder) (upxBlock, bool) {
+	if position < 0 || position+upxInfoLen > len(data) {
+		return upxBlock{}, false
+	}
+	return upxBlock{
+		uncompressedSize: order.Uint32(data[position:]),
+		compressedSize:   order.Uint32(data[position+4:]),
+		method:           data[position+8],
+		filter:           data[position+9],
+	}, true
+}
+
+func (b upxBlock) valid(blockSize uint32, remaining int) bool {
+	if b.uncompressedSize == 0 || b.uncompressedSize > blockSize {
+		return false
+	}
+	if b.compressedSize == 0 || b.compressedSize > b.uncompressedSize || int64(b.compressedSize) > int64(remaining) {
+		return false
+	}
+	if b.compressedSize == b.uncompressedSize {
+		// Stored
+		return true
+	}
+	switch b.method {
+	case upxNRV2BLE32, upxNRV2B8, upxNRV2BLE16,
+		upxNRV2DLE32, upxNRV2D8, upxNRV2DLE16,
+		upxNRV2ELE32, upxNRV2E8, upxNRV2ELE16,
+		upxLZMA, upxDeflate:
+		return true
+	}
+	return false
+}
+
+// unpackUPXBlocks follows the chain of b_info headers starting at position
+// until the end marker (a zero uncompressed size)
+func unpackUPXBlocks(data []byte, position int, order binary.ByteOrder, blockSize uint32) ([]byte, error) {
+	var out bytes.Buffer
+	blocks := 0
+	for {
+		block, ok := readUPXBlock(data, position, order)
+		if !ok {
+			break
+		}
+		if block.uncompressedSize == 0 {
+			// End marker
+			break
+		}
+
+		if !block.valid(blockSize, len(data)-position-upxInfoLen) {
+			// Blocks are 4 byte aligned in some layouts, skip the padding
+			aligned := (position + 3) &^ 3
+			if aligned != position && bytes.Count(data[position:aligned], []byte{0}) == aligned-position {
+				position = aligned
+				continue
+			}
+			break
+		}
+
+		src := data[position+upxInfoLen : position+upxInfoLen+int(block.compressedSize)]
+		var unpacked []byte
+		if block.compressedSize == block.uncompressedSize {
+			unpacked = src
+		} else {
+			var err error
+			unpacked, err = upxDecompress(block.method, src, int(block.uncompressedSize))
+			if err != nil {
+				return nil, fmt.Errorf("couldn't decompress UPX block %d at offset %d: %w", blocks, position, err)
+			}
+		}
+
+		debugPrintf("  UPX block %d at offset %d: method=%d, filter=%#x, %d -> %d bytes\n",
+			blocks, position, block.method, block.filter, block.compressedSize, len(unpacked))
+
+		if out.Len()+len(unpacked) > maxUPXSize {
+			return nil, fmt.Errorf("UPX image exceeds %d bytes", maxUPXSize)
+		}
+		out.Write(unpacked)
+		position += upxInfoLen + int(block.compressedSize)
+		blocks++
+	}
+
+	if blocks == 0 {
+		return nil, fmt.Errorf("no UPX blocks found at offset %d", position)
+	}
+	return out.Bytes(), nil
+}
+
+func upxDecompress(method byte, src []byte, size int) ([]byte, error) {
+	if int64(size) > int64(len(src))*maxUPXRatio {
+		return nil, fmt.Errorf("%d bytes can't decompress to %d bytes", len(src), size)
+	}
+	switch method {
+	case upxNRV2BLE32:
+		return nrv2bDecompress(src, size, 32)
+	case upxNRV2B8:
+		return nrv2bDecompress(src, size, 8)
+	case upxNRV2BLE16:
+		return nrv2bDecompress(src, size, 16)
+	case upxNRV2DLE32:
+		return nrv2deDecompress(src, size, 32, false)
+	case upxNRV2D8:
+		return nrv2deDecompress(src, size, 8, false)
+	case upxNRV2DLE16:
+		return nrv2deDecompress(src, size, 16, false)
+	case upxNRV2ELE32:
+		return nrv2deDecompress(src, size, 32, true)
+	case upxNRV2E8:
+		return nrv2deDecompress(src, size, 8, true)
+	case upxNRV2ELE16:
+		return nrv2deDecompress(src, size, 16, true)
+	case upxLZMA:
+		return upxLZMADecompress(src, size)
+	case upxDeflate:
+		return readAllLimited(flate.NewReader(bytes.NewReader(src)), size)
+	}
+	return nil, fmt.Errorf("unsupported UPX method %d", method)
+}
+
+// readAllLimited reads exactly size bytes from r. The buffer grows with the
+// data actually read rather than the size claimed by the header.
+func readAllLimited(r io.Reader, size int) ([]byte, error) {
+	out, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return out, nil
+}
+
+// upxLZMADecompress decodes UPX's LZMA blocks, which replace the usual 13 byte
+// header with two bytes holding the pb, lp and lc properties
+func upxLZMADecompress(src []byte, size int) ([]byte, error) {
+	if len(src) < 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	// The first byte is (lc+lp)<<3 | pb and the second lp<<4 | lc
+	pb := int(src[0] & 7)
+	lp := int(src[1] >> 4)
+	lc := int(src[1] & 15)
+	if int(src[0]>>3) != lc+lp {
+		return nil, fmt.Errorf("invalid UPX LZMA header %#x %#x", src[0], src[1])
+	}
+
+	// The dictionary is allocated upfront, size is bounded by maxUPXRatio
+	dictCap := size
+	if dictCap < lzma.MinDictCap {
+		dictCap = lzma.MinDictCap
+	}
+
+	header := make([]byte, lzma.HeaderLen)
+	header[0] = byte((pb*5+lp)*9 + lc)
+	binary.LittleEndian.PutUint32(header[1:], uint32(dictCap))
+	binary.LittleEndian.PutUint64(header[5:], uint64(size))
+
+	reader, err := lzma.NewReader(io.MultiReader(bytes.NewReader(header), bytes.NewReader(src[2:])))
+	if err != nil {
+		return nil, err
+	}
+	return readAllLimited(reader, size)
+}
+
+// nrvBits reads the bit stream of the UCL NRV algorithms, which interleaves
+// literal bytes with little endian words of flag bits read MSB first
+type nrvBits struct {
+	src   []byte
+	ilen  int
+	width int // bits per flag word: 8, 16 or 32
+	bb    uint32
+	bc    int
+	err   error
+}
+
+func (r *nrvBits) bit() uint32 {
+	if r.bc == 0 {
+		n := r.width / 8
+		if r.ilen+n > len(r.src) {
+			r.err = io.ErrUnexpectedEOF
+			return 0
+		}
+		switch r.width {
+		case 8:
+			r.bb = uint32(r.src[r.ilen])
+		case 16:
+			r.bb = uint32(binary.LittleEndian.Uint16(r.src[r.ilen:]))
+		default:
+			r.bb = binary.LittleEndian.Uint32(r.src[r.ilen:])
+		}
+		r.ilen += n
+		r.bc = r.width
+	}
+	r.bc--
+	return (r.bb >> uint(r.bc)) & 1
+}
+
+func (r *nrvBits) byte() uint32 {
+	if r.ilen >= len(r.src) {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	b := r.src[r.ilen]
+	r.ilen++
+	return uint32(b)
+}
+
+// nrvCopy appends a match of length n at distance off to dst
+func nrvCopy(dst []byte, off uint32, n uint32, size int) ([]byte, error) {
+	if off == 0 || int64(off) > int64(len(dst)) {
+		return nil, fmt.Errorf("invalid match offset %d at output position %d", off, len(dst))
+	}
+	if int64(len(dst))+int64(n) > int64(size) {
+		return nil, fmt.Errorf("match overruns output size %d", size)
+	}
+	pos := len(dst) - int(off)
+	for i := 0; i < int(n); i++ {
+		dst = append(dst, dst[pos+i])
+	}
+	return dst, nil
+}
+
+// nrv2bDecompress is a port of ucl_nrv2b_decompress from the UCL library
+func nrv2bDecompress(src []byte, size int, width int) ([]byte, error) {
+	r := &nrvBits{src: src, width: width}
+	dst := make([]byte, 0, size)
+	lastOff := uint32(1)
+	for {
+		for r.bit() == 1 && r.err == nil {
+			if len(dst) >= size {
+				return nil, fmt.Errorf("literal overruns output size %d", size)
+			}
+			dst = append(dst, byte(r.byte()))
+		}
+
+		off := uint32(1)
+		for {
+			off = off*2 + r.bit()
+			if r.bit() == 1 || r.err != nil || off > 0x1000002 {
+				break
+			}
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		if off == 2 {
+			off = lastOff
+		} else {
+			off = (off-3)*256 + r.byte()
+			if off == 0xffffffff {
+				break
+			}
+			off++
+			lastOff = off
+		}
+
+		n := r.bit()
+		n = n*2 + r.bit()
+		if n == 0 {
+			n++
+			for {
+				n = n*2 + r.bit()
+				if r.bit() == 1 || r.err != nil || n > uint32(size) {
+					break
+				}
+			}
+			n += 2
+		}
+		if off > 0xd00 {
+			n++
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		var err error
+		if dst, err = nrvCopy(dst, off, n+1, size); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(dst) != size {
+		return nil, fmt.Errorf("decompressed %d bytes, expected %d", len(dst), size)
+	}
+	return dst, nil
+}
+
+// nrv2deDecompress is a port of ucl_nrv2d_decompress and ucl_nrv2e_decompress
+// from the UCL library, which only differ in how match lengths are coded
+func nrv2deDecompress(src []byte, size int, width int, nrv2e bool) ([]byte, error) {
+	r := &nrvBits{src: src, width: width}
+	dst := make([]byte, 0, size)
+	lastOff := uint32(1)
+	for {
+		for r.bit() == 1 && r.err == nil {
+			if len(dst) >= size {
+				return nil, fmt.Errorf("literal overruns output size %d", size)
+			}
+			dst = append(dst, byte(r.byte()))
+		}
+
+		off := uint32(1)
+		for {
+			off = off*2 + r.bit()
+			if r.bit() == 1 || r.err != nil || off > 0x1000002 {
+				break
+			}
+			off = (off-1)*2 + r.bit()
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		var n uint32
+		if off == 2 {
+			off = lastOff
+			n = r.bit()
+		} else {
+			off = (off-3)*256 + r.byte()
+			if off == 0xffffffff {
+				break
+			}
+			n = (off ^ 0xffffffff) & 1
+			off >>= 1
+			off++
+			lastOff = off
+		}
+
+		if nrv2e {
+			if n != 0 {
+				n = 1 + r.bit()
+			} else if r.bit() == 1 {
+				n = 3 + r.bit()
+			} else {
+				n++
+				for {
+					n = n*2 + r.bit()
+					if r.bit() == 1 || r.err != nil || n > uint32(size) {
+						break
+					}
+				}
+				n += 3
+			}
+		} else {
+			n = n*2 + r.bit()
+			if n == 0 {
+				n++
+				for {
+					n = n*2 + r.bit()
+					if r.bit() == 1 || r.err != nil || n > uint32(size) {
+						break
+					}
+				}
+				n += 2
+			}
+		}
+		if off > 0x500 {
+			n++
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		var err error
+		if dst, err = nrvCopy(dst, off, n+1, size); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(dst) != size {
+		return nil, fmt.Errorf("decompressed %d bytes, expected %d", len(dst), size)
+	}
+	return dst, nil
+}
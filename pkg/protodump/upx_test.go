@@ -0,0 +1,330 @@
+package protodump
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// nrvWriter produces the UCL NRV bit stream: flag bits are packed MSB first
+// into little endian 32 bit words that are reserved in the output when their
+// first bit is written, and literal bytes are appended as they come.
+type nrvWriter struct {
+	out     []byte
+	wordPos int
+	bc      int
+	method  byte
+	lastOff int
+}
+
+func (w *nrvWriter) bit(b int) {
+	if w.bc == 0 {
+		w.wordPos = len(w.out)
+		w.out = append(w.out, 0, 0, 0, 0)
+		w.bc = 32
+	}
+	w.bc--
+	if b != 0 {
+		word := binary.LittleEndian.Uint32(w.out[w.wordPos:])
+		binary.LittleEndian.PutUint32(w.out[w.wordPos:], word|1<<uint(w.bc))
+	}
+}
+
+func (w *nrvWriter) byte(b byte) {
+	w.out = append(w.out, b)
+}
+
+// gamma writes v >= 2 in the encoding read by `do { v = v*2 + bit } while (!bit)`
+func (w *nrvWriter) gamma(v uint32) {
+	var bits []int
+	for ; v > 1; v >>= 1 {
+		bits = append(bits, int(v&1))
+	}
+	for i := len(bits) - 1; i >= 0; i-- {
+		w.bit(bits[i])
+		if i == 0 {
+			w.bit(1)
+		} else {
+			w.bit(0)
+		}
+	}
+}
+
+// gamma2 writes v >= 2 in the paired encoding used for NRV2D/2E offsets
+func (w *nrvWriter) gamma2(v uint32) {
+	// The last step is v = 2m + b; every step before it is m = 4m' + 2b1 + b2 - 2
+	type step struct{ b1, b2 int }
+	last := int(v & 1)
+	m := v >> 1
+	var steps []step
+	for m > 1 {
+		steps = append(steps, step{int((m+2)>>1) & 1, int(m+2) & 1})
+		m = (m + 2) >> 2
+	}
+	for i := len(steps) - 1; i >= 0; i-- {
+		w.bit(steps[i].b1)
+		w.bit(0)
+		w.bit(steps[i].b2)
+	}
+	w.bit(last)
+	w.bit(1)
+}
+
+func (w *nrvWriter) literal(b byte) {
+	w.bit(1)
+	w.byte(b)
+}
+
+func (w *nrvWriter) match(off int, length int) {
+	w.bit(0)
+	switch w.method {
+	case upxNRV2BLE32:
+		if off == w.lastOff {
+			w.gamma(2)
+		} else {
+			w.gamma(uint32((off-1)>>8) + 3)
+			w.byte(byte(off - 1))
+		}
+		n := length - 1
+		if off > 0xd00 {
+			n--
+		}
+		if n <= 3 {
+			w.bit(n >> 1)
+			w.bit(n & 1)
+		} else {
+			w.bit(0)
+			w.bit(0)
+			w.gamma(uint32(n - 2))
+		}
+	default:
+		n := length - 1
+		if off > 0x500 {
+			n--
+		}
+		// The first length bit rides along in the offset for new offsets
+		var first int
+		if w.method == upxNRV2ELE32 {
+			if n <= 2 {
+				first = 1
+			}
+		} else if n <= 3 {
+			first = n >> 1
+		}
+		if off == w.lastOff {
+			w.gamma2(2)
+			w.bit(first)
+		} else {
+			raw := uint32(off-1)<<1 | uint32(1-first)
+			w.gamma2(raw>>8 + 3)
+			w.byte(byte(raw))
+		}
+		if w.method == upxNRV2ELE32 {
+			switch {
+			case n <= 2:
+				w.bit(n - 1)
+			case n <= 4:
+				w.bit(1)
+				w.bit(n - 3)
+			default:
+				w.bit(0)
+				w.gamma(uint32(n - 3))
+			}
+		} else if n <= 3 {
+			w.bit(n & 1)
+		} else {
+			w.bit(0)
+			w.gamma(uint32(n - 2))
+		}
+	}
+	w.lastOff = off
+}
+
+func (w *nrvWriter) end() {
+	w.bit(0)
+	if w.method == upxNRV2BLE32 {
+		w.gamma(0x1000002)
+	} else {
+		w.gamma2(0x1000002)
+	}
+	w.byte(0xff)
+}
+
+// nrvCompress greedily encodes data with the given NRV method
+func nrvCompress(method byte, data []byte) []byte {
+	w := &nrvWriter{method: method, lastOff: 1}
+	for i := 0; i < len(data); {
+		bestOff, bestLen := 0, 0
+		for j := 0; j < i; j++ {
+			n := 0
+			for i+n < len(data) && data[j+n] == data[i+n] {
+				n++
+			}
+			if n > bestLen {
+				bestOff, bestLen = i-j, n
+			}
+		}
+		if bestLen >= 4 {
+			w.match(bestOff, bestLen)
+			i += bestLen
+		} else {
+			w.literal(data[i])
+			i++
+		}
+	}
+	w.end()
+	return w.out
+}
+
+func lzmaCompress(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	lw, err := lzma.WriterConfig{Size: int64(len(data))}.NewWriter(&buf)
+	assert.NoError(t, err)
+	_, err = lw.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, lw.Close())
+	// UPX keeps (lc+lp)<<3 | pb in the first byte and lp<<4 | lc in the
+	// second instead of the usual 13 byte header, here lc=3, lp=0 and pb=2
+	return append([]byte{3<<3 | 2, 0<<4 | 3}, buf.Bytes()[lzma.HeaderLen:]...)
+}
+
+func deflateCompress(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.BestCompression)
+	assert.NoError(t, err)
+	_, err = fw.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Close())
+	return buf.Bytes()
+}
+
+func TestUPXDecompress(t *testing.T) {
+	data := bytes.Repeat(descriptorBytes(t)[:2000], 3)
+
+	for _, method := range []byte{upxNRV2BLE32, upxNRV2DLE32, upxNRV2ELE32} {
+		unpacked, err := upxDecompress(method, nrvCompress(method, data), len(data))
+		assert.NoError(t, err, "method %d", method)
+		assert.Equal(t, data, unpacked, "method %d", method)
+	}
+
+	compressed := lzmaCompress(t, data)
+	unpacked, err := upxDecompress(upxLZMA, compressed, len(data))
+	assert.NoError(t, err)
+	assert.Equal(t, data, unpacked)
+	_, err = upxDecompress(upxLZMA, append([]byte{2, 3}, compressed[2:]...), len(data))
+	assert.Error(t, err)
+
+	unpacked, err = upxDecompress(upxDeflate, deflateCompress(t, data), len(data))
+	assert.NoError(t, err)
+	assert.Equal(t, data, unpacked)
+
+	// Sizes claimed by garbage headers are refused before allocating
+	for _, method := range []byte{upxNRV2BLE32, upxLZMA, upxDeflate} {
+		_, err = upxDecompress(method, compressed[:16], maxUPXSize)
+		assert.ErrorContains(t, err, "can't decompress to", "method %d", method)
+	}
+	_, err = upxDecompress(upxDeflate, deflateCompress(t, data), len(data)+1)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestUnpackUPX(t *testing.T) {
+	descriptor := descriptorBytes(t)
+	image := append(append(make([]byte, 256), descriptor...), make([]byte, 256)...)
+	const blockSize = 4096
+
+	var packed []byte
+	packed = append(packed, []byte("\x7fELF\x02\x01\x01")...)
+	packed = append(packed, make([]byte, 57)...)
+	packed = append(packed, 0, 0, 0, 0) // l_checksum
+	packed = append(packed, upxMagic...)
+	packed = append(packed, 0, 0, 13, 22) // l_lsize, l_version, l_format
+	packed = binary.LittleEndian.AppendUint32(packed, 0)
+	packed = binary.LittleEndian.AppendUint32(packed, uint32(len(image)))
+	packed = binary.LittleEndian.AppendUint32(packed, blockSize)
+
+	methods := []byte{upxNRV2ELE32, upxLZMA, upxNRV2BLE32, upxDeflate}
+	for i := 0; i*blockSize < len(image); i++ {
+		end := (i + 1) * blockSize
+		if end > len(image) {
+			end = len(image)
+		}
+		block := image[i*blockSize : end]
+		method := methods[i%len(methods)]
+		var compressed []byte
+		switch method {
+		case upxLZMA:
+			compressed = lzmaCompress(t, block)
+		case upxDeflate:
+			compressed = deflateCompress(t, block)
+		default:
+			compressed = nrvCompress(method, block)
+		}
+		packed = binary.LittleEndian.AppendUint32(packed, uint32(len(block)))
+		packed = binary.LittleEndian.AppendUint32(packed, uint32(len(compressed)))
+		packed = append(packed, method, 0, 0, 0)
+		packed = append(packed, compressed...)
+	}
+	packed = append(packed, 0, 0, 0, 0)
+	packed = append(packed, upxMagic...)
+	packed = append(packed, 0, 0, 0, 0)
+
+	assert.True(t, IsUPX(packed))
+	unpacked, err := UnpackUPX(packed)
+	assert.NoError(t, err)
+	assert.Equal(t, image, unpacked)
+	assert.Equal(t, [][]byte{descriptor}, Scan(unpacked))
+
+	_, err = UnpackUPX(descriptor)
+	assert.ErrorIs(t, err, ErrNotUPX)
+}
+
+func TestUPXSamples(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join("testdata", "upx", "*.upx"))
+	assert.NoError(t, err)
+	if len(samples) == 0 {
+		if os.Getenv("PROTODUMP_UPX_SAMPLES") == "required" {
+			t.Fatal("no UPX packed samples, make upx-testdata failed")
+		}
+		t.Skip("no UPX packed samples, run make upx-testdata")
+	}
+
+	for _, sample := range samples {
+		t.Run(filepath.Base(sample), func(t *testing.T) {
+			data, err := os.ReadFile(sample)
+			assert.NoError(t, err)
+			assert.True(t, IsUPX(data))
+
+			results, err := ScanFileResults(sample)
+			assert.NoError(t, err)
+			var names []string
+			for _, result := range results {
+				assert.True(t, strings.HasPrefix(result.Method, MethodUPX+"+"), result.Method)
+				names = append(names, descriptorName(result.Data))
+			}
+			assert.Contains(t, names, "render_options.proto")
+		})
+	}
+}
+
+func TestScanUPXFallback(t *testing.T) {
+	// Mentions UPX without being packed
+	descriptor := descriptorBytes(t)
+	data := append([]byte("\x7fELF\x02\x01\x01UPX!"), make([]byte, 64)...)
+	data = append(data, descriptor...)
+	assert.True(t, IsUPX(data))
+
+	path := filepath.Join(t.TempDir(), "server")
+	assert.NoError(t, os.WriteFile(path, data, 0600))
+	results, err := ScanFileResults(path)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{descriptor}, resultsData(results))
+	assert.Equal(t, MethodRaw, results[0].Method)
+}
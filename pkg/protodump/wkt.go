@@ -0,0 +1,54 @@
+package protodump
+
+import (
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/apipb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/sourcecontextpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/typepb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+// wellKnownFiles are the well-known types files compiled into
+// google.golang.org/protobuf, by path
+var wellKnownFiles = make(map[string]protoreflect.FileDescriptor)
+
+func init() {
+	for _, file := range []protoreflect.FileDescriptor{
+		anypb.File_google_protobuf_any_proto,
+		apipb.File_google_protobuf_api_proto,
+		durationpb.File_google_protobuf_duration_proto,
+		emptypb.File_google_protobuf_empty_proto,
+		fieldmaskpb.File_google_protobuf_field_mask_proto,
+		sourcecontextpb.File_google_protobuf_source_context_proto,
+		structpb.File_google_protobuf_struct_proto,
+		timestamppb.File_google_protobuf_timestamp_proto,
+		typepb.File_google_protobuf_type_proto,
+		wrapperspb.File_google_protobuf_wrappers_proto,
+		descriptorpb.File_google_protobuf_descriptor_proto,
+		pluginpb.File_google_protobuf_compiler_plugin_proto,
+	} {
+		wellKnownFiles[file.Path()] = file
+	}
+}
+
+// WellKnownFile returns the canonical version of the well-known types file
+// at path, e.g. google/protobuf/timestamp.proto
+func WellKnownFile(path string) (protoreflect.FileDescriptor, bool) {
+	file, ok := wellKnownFiles[path]
+	return file, ok
+}
+
+// IsWellKnown reports whether the definition is a well-known types file,
+// typically a copy linked into the binary along with the protobuf runtime
+func (pd *ProtoDefinition) IsWellKnown() bool {
+	_, ok := WellKnownFile(pd.descriptor.Path())
+	return ok
+}
@@ -0,0 +1,38 @@
+package protodump
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWellKnownImports(t *testing.T) {
+	files, err := convertProtoToFileDescriptors(path.Join("testdata", "minimal_names.proto"), "--include_imports")
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 2) {
+		return
+	}
+
+	// The binary's own copy of timestamp.proto is used and tagged
+	batch := NewBatch(files)
+	assert.Empty(t, batch.Registry.CanonicalImports())
+	assert.Empty(t, batch.WellKnownImports())
+	assert.True(t, batch.Definitions[0].IsWellKnown())
+	assert.False(t, batch.Definitions[1].IsWellKnown())
+
+	// Without it, the import resolves against the canonical version, which
+	// is written in its place
+	batch = NewBatch(files[1:])
+	assert.Empty(t, batch.Registry.UnresolvedImports())
+	assert.Equal(t, []string{"google/protobuf/timestamp.proto"}, batch.Registry.CanonicalImports())
+	assert.Empty(t, batch.Stubs())
+	canonical := batch.WellKnownImports()
+	if !assert.Len(t, canonical, 1) {
+		return
+	}
+	assert.True(t, canonical[0].IsWellKnown())
+	assert.Equal(t, "google/protobuf/timestamp.proto", canonical[0].Filename())
+	assert.Contains(t, canonical[0].String(), "package google.protobuf;\n")
+	assert.Contains(t, canonical[0].String(), "message Timestamp {\n  int64 seconds = 1;\n  int32 nanos = 2;\n}\n")
+}